@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/widget"
+)
+
+var sECRET_KEYS = []string{"MOZ_TOKEN", "PRIV_KEY", "PUB_KEY", "STALE_PUB_KEY"}
+
+func (m *MozApp) Logout(removeDevice bool) error {
+	// Waits for a connect that is still in progress and tears it down too.
+	err := m.Disconnect()
+	if err != nil {
+		return fmt.Errorf("unable to disconnect before logout err:%w", err)
+	}
+
+	mozToken := m.Token()
+	_, pubKey := m.GetKeys()
+
+	err = m.Client.Logout(m.ctx, pubKey, mozToken, removeDevice)
+	if err != nil {
+		return fmt.Errorf("unable to logout err:%w", err)
+	}
+
+	if m.externalToken == "" {
+		for _, key := range sECRET_KEYS {
+			m.App.Preferences().RemoveValue(key)
+		}
+	}
+	m.externalToken = ""
+	m.externalPrivKey = ""
+	m.externalPubKey = ""
+	m.User = nil
+	return nil
+}
+
+func (m *MozApp) accountText() string {
+	if m.User == nil {
+		return "Not logged in"
+	}
+	if m.User.DisplayName != "" {
+		return fmt.Sprintf("Logged in as %s (%s)", m.User.DisplayName, m.User.Email)
+	}
+	return fmt.Sprintf("Logged in as %s", m.User.Email)
+}
+
+func (m *MozApp) newAccountView(onChange func()) fyne.CanvasObject {
+	accountLabel := widget.NewLabel(m.accountText())
+
+	var logoutButton *widget.Button
+	var loginButton *widget.Button
+
+	refresh := func() {
+		accountLabel.SetText(m.accountText())
+		if m.User == nil {
+			logoutButton.Disable()
+			loginButton.Enable()
+		} else {
+			logoutButton.Enable()
+			loginButton.Disable()
+		}
+		onChange()
+	}
+
+	loginButton = widget.NewButton("Log in", func() {
+		loginButton.Disable()
+		accountLabel.SetText("Waiting for login in the browser...")
+		go func() {
+			err := m.InitUser()
+			if err == nil {
+				err = m.CheckDevice()
+			}
+			if err != nil {
+				log.Printf("Unable to log in err:%s\n", err)
+				dialog.ShowError(err, m.Window)
+			}
+			refresh()
+		}()
+	})
+
+	logoutButton = widget.NewButton("Log out", func() {
+		removeDevice := widget.NewCheck("Also remove this device from the account", nil)
+		removeDevice.SetChecked(true)
+		dialog.ShowCustomConfirm("Log out", "Log out", "Cancel", removeDevice, func(ok bool) {
+			if !ok {
+				return
+			}
+			err := m.Logout(removeDevice.Checked)
+			if err != nil {
+				log.Printf("Unable to log out err:%s\n", err)
+				dialog.ShowError(err, m.Window)
+			}
+			refresh()
+		}, m.Window)
+	})
+
+	if m.User == nil {
+		logoutButton.Disable()
+	} else {
+		loginButton.Disable()
+	}
+
+	return container.New(layout.NewVBoxLayout(),
+		accountLabel,
+		loginButton,
+		logoutButton,
+	)
+}
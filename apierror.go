@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var ErrUnauthorized = errors.New("the Mozilla token was rejected")
+
+// Mozilla answers failed requests with a body like
+// {"code":401,"errno":120,"error":"Unauthorized"}. Mullvad uses
+// {"code":"...","error":"..."}, so Code holds either as text without quotes.
+type APIError struct {
+	StatusCode int
+	Endpoint   string
+	Errno      int
+	Code       string
+	Message    string
+	Body       string
+}
+
+type apiErrorBody struct {
+	Errno   int             `json:"errno"`
+	Code    json.RawMessage `json:"code"`
+	Error   string          `json:"error"`
+	Message string          `json:"message"`
+}
+
+func newAPIError(req *http.Request, res *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		Endpoint:   fmt.Sprintf("%s %s", req.Method, req.URL.Path),
+	}
+
+	bodyBytes, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return apiErr
+	}
+	apiErr.Body = string(bodyBytes)
+
+	var body apiErrorBody
+	err = json.Unmarshal(bodyBytes, &body)
+	if err != nil {
+		return apiErr
+	}
+
+	apiErr.Errno = body.Errno
+	apiErr.Code = strings.Trim(string(body.Code), `"`)
+	apiErr.Message = body.Error
+	if apiErr.Message == "" {
+		apiErr.Message = body.Message
+	}
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	if e.Errno != 0 {
+		return fmt.Sprintf("%s returned HTTP %d errno:%d %s", e.Endpoint, e.StatusCode, e.Errno, message)
+	}
+	return fmt.Sprintf("%s returned HTTP %d %s", e.Endpoint, e.StatusCode, message)
+}
+
+func (e *APIError) IsUnauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized
+}
+
+func (e *APIError) IsServerError() bool {
+	return e.StatusCode >= 500
+}
+
+// Guardian does not document a dedicated errno for a full account, so this
+// goes by the status and the wording of the message.
+func (e *APIError) IsDeviceLimit() bool {
+	if e.StatusCode < 400 || e.StatusCode >= 500 {
+		return false
+	}
+	message := strings.ToLower(e.Message)
+	return strings.Contains(message, "device") &&
+		(strings.Contains(message, "max") || strings.Contains(message, "limit"))
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.IsUnauthorized()
+	case ErrDeviceLimit:
+		return e.IsDeviceLimit()
+	}
+	return false
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
-	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
@@ -22,13 +26,36 @@ type SelectState struct {
 }
 
 type MozApp struct {
-	App         fyne.App
-	Window      fyne.Window
-	Client      *MozClient
-	User        *User
-	connected   bool
-	relayList   *RelayList
-	selectState SelectState
+	App    fyne.App
+	Window fyne.Window
+	Client *MozClient
+	User   *User
+	// tunnelMu serializes Connect and Disconnect, which can take a while.
+	// connMu only guards the fields below so the UI can read them meanwhile.
+	tunnelMu  sync.Mutex
+	connMu    sync.Mutex
+	connected bool
+	// Hostname of the relay in use, which may have been picked automatically.
+	connectedRelay string
+	tunnel         *Tunnel
+	relayState     atomic.Pointer[loadedRelays]
+	selectMu       sync.Mutex
+	selectState    SelectState
+
+	prober       RelayProber
+	latencyCache *LatencyCache
+
+	externalToken   string
+	externalPrivKey string
+	externalPubKey  string
+
+	relayLoadMu     sync.Mutex
+	relayLoadGen    uint64
+	relayLoadCancel context.CancelFunc
+
+	// Cancelled when the window closes so in-flight API calls stop with it.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 var APP_UUID = "c8497240-20ca-11ef-8bd1-27e3d5bda132"
@@ -38,22 +65,26 @@ func newMozApp() *MozApp {
 	mainWindow := app.NewWindow("Mozilla VPN")
 	mainWindow.Resize(fyne.NewSize(500, 500))
 
-	mozClient := MozClient{
-		client: &http.Client{},
-	}
-	relayList, err := mozClient.GetRelayList()
-
+	mozClient := NewMozClient(nil, EndpointsFromEnv())
+	relayCache, err := NewRelayCache()
 	if err != nil {
-		log.Printf("Unable to get relay list err:%s\n", err)
+		log.Printf("Unable to use relay cache err:%s\n", err)
+	} else {
+		mozClient.SetRelayCache(relayCache)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	mozApp := &MozApp{
-		App:       app,
-		Window:    mainWindow,
-		Client:    &mozClient,
-		User:      nil,
-		connected: false,
-		relayList: relayList,
+		App:          app,
+		Window:       mainWindow,
+		ctx:          ctx,
+		cancel:       cancel,
+		Client:       mozClient,
+		User:         nil,
+		connected:    false,
+		prober:       &TCPProber{Port: pROBE_PORT, Timeout: pROBE_TIMEOUT},
+		latencyCache: NewLatencyCache(lATENCY_CACHE_TTL),
 		selectState: SelectState{
 			Country: "",
 			City:    "",
@@ -65,34 +96,87 @@ func newMozApp() *MozApp {
 }
 
 func (m *MozApp) InitUser() error {
-	mozToken := m.App.Preferences().String("MOZ_TOKEN")
-
-	if mozToken == "" {
-		res, err := m.Client.Login()
+	token, source, err := externalToken()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		user, err := m.Client.GetUser(m.ctx, token)
 		if err != nil {
-			return fmt.Errorf("unable perform Login err:%s", err)
+			return fmt.Errorf("token from %s was rejected err:%w", source, err)
 		}
 
-		newMozToken := res.Token
-		m.App.Preferences().SetString("MOZ_TOKEN", newMozToken)
-		mozToken = newMozToken
-
-		m.User = &res.User
-		return nil
-	} else {
-		user, err := m.Client.GetUser(mozToken)
+		privKey, pubKey, err := externalKeys()
 		if err != nil {
-			return fmt.Errorf("unable perform GetUser err:%s", err)
+			return err
+		}
+		// A key generated per run would register a new device every time and
+		// fill the account after a few runs.
+		if privKey == "" {
+			return fmt.Errorf("token from %s needs a device key in %s or %s", source, pRIVATE_KEY_ENV, pRIVATE_KEY_FILE_ENV)
 		}
 
+		m.externalToken = token
+		m.externalPrivKey = privKey
+		m.externalPubKey = pubKey
 		m.User = user
 		return nil
 	}
+
+	mozToken := m.App.Preferences().String("MOZ_TOKEN")
+
+	if mozToken == "" {
+		return m.login()
+	}
+
+	user, err := m.Client.GetUser(m.ctx, mozToken)
+	if errors.Is(err, ErrUnauthorized) {
+		log.Printf("Stored token was rejected, logging in again err:%s\n", err)
+		m.App.Preferences().RemoveValue("MOZ_TOKEN")
+		return m.login()
+	} else if err != nil {
+		return fmt.Errorf("unable perform GetUser err:%w", err)
+	}
+
+	m.User = user
+	return nil
+}
+
+func useHeadlessLogin() bool {
+	if os.Getenv("MOZ_VPN_HEADLESS_LOGIN") != "" {
+		return true
+	}
+	return os.Getenv("SSH_CONNECTION") != "" && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+}
+
+func (m *MozApp) login() error {
+	var res *Root
+	var err error
+	if useHeadlessLogin() {
+		res, err = m.Client.LoginHeadless(m.ctx, os.Stdin, os.Stdout)
+	} else {
+		res, err = m.Client.Login(m.ctx, os.Stdin, os.Stdout)
+	}
+	if err != nil {
+		return fmt.Errorf("unable perform Login err:%w", err)
+	}
+
+	m.App.Preferences().SetString("MOZ_TOKEN", res.Token)
+	m.User = &res.User
+	return nil
 }
 
 func (m *MozApp) CheckDevice() error {
-	mozToken := m.App.Preferences().String("MOZ_TOKEN")
-	currPubKey := m.App.Preferences().String("PUB_KEY")
+	mozToken := m.Token()
+	currPrivKey, currPubKey := m.GetKeys()
+
+	if isEd25519KeyPair(currPrivKey, currPubKey) {
+		log.Println("Found an ed25519 key pair, migrating to a WireGuard key")
+		return m.migrateEd25519Keys(mozToken, currPubKey)
+	}
+	if m.externalToken == "" {
+		m.removeStaleDevice(mozToken)
+	}
 
 	found := false
 	if currPubKey != "" {
@@ -109,96 +193,112 @@ func (m *MozApp) CheckDevice() error {
 	}
 
 	if !found && len(m.User.Devices) < 5 {
-		newPubBytes, newPrivBytes, err := ed25519.GenerateKey(rand.Reader)
-		if err != nil {
-			return fmt.Errorf("error generating key err:%s", err)
-		}
+		return m.registerDevice(mozToken)
+	} else if !found && len(m.User.Devices) >= 5 {
+		return ErrDeviceLimit
+	}
 
-		newPubKey := base64.StdEncoding.EncodeToString(newPubBytes)
-		newPrivKey := base64.StdEncoding.EncodeToString(newPrivBytes)
+	return nil
+}
 
-		_, _ = m.Client.UploadDevice(newPubKey, mozToken)
+func (m *MozApp) registerDevice(mozToken string) error {
+	newPrivKey, newPubKey, err := m.newDeviceKeys()
+	if err != nil {
+		return err
+	}
 
-		m.App.Preferences().SetString("PRIV_KEY", newPrivKey)
-		m.App.Preferences().SetString("PUB_KEY", newPubKey)
-	} else if !found && len(m.User.Devices) >= 5 {
-		return fmt.Errorf("you need to remove some devices because Mozilla VPN only supports up to 5 public keys")
+	res, err := m.Client.UploadDevice(m.ctx, newPubKey, mozToken)
+	if err != nil {
+		return fmt.Errorf("unable to upload device err:%w", err)
 	}
 
+	m.setKeys(newPrivKey, newPubKey)
+
+	m.User.Devices = append(m.User.Devices, Device{
+		Name:        res.Name,
+		UniqueID:    &res.UniqueID,
+		Pubkey:      res.Pubkey,
+		IPv4Address: res.IPv4Address,
+		IPv6Address: res.IPv6Address,
+		CreatedAt:   res.CreatedAt,
+	})
 	return nil
 }
 
-func (m MozApp) GetKeys() (string, string) {
-	return m.App.Preferences().String("PRIV_KEY"), m.App.Preferences().String("PUB_KEY")
+func (m *MozApp) removeDeviceFromUser(pubKey string) {
+	devices := make([]Device, 0, len(m.User.Devices))
+	for _, d := range m.User.Devices {
+		if d.Pubkey != pubKey {
+			devices = append(devices, d)
+		}
+	}
+	m.User.Devices = devices
 }
 
-func (m *MozApp) InitUi() error {
-	// _, pubKey := m.GetKeys()
+func (m *MozApp) migrateEd25519Keys(mozToken string, stalePubKey string) error {
+	staleRegistered := false
+	for _, d := range m.User.Devices {
+		if d.Pubkey == stalePubKey {
+			staleRegistered = true
+			break
+		}
+	}
 
-	// deviceList := widget.NewList(
-	// 	func() int {
-	// 		return len(m.User.Devices)
-	// 	},
-	// 	func() fyne.CanvasObject {
-	// 		name := widget.NewLabel("")
-	// 		// uniqueIdStr := widget.NewLabel("")
-	// 		pubKey := widget.NewLabel("")
-	// 		ipv4 := widget.NewLabel("")
-	// 		ipv6 := widget.NewLabel("")
-	// 		createdAt := widget.NewLabel("")
-
-	// 		background := canvas.NewRectangle(color.RGBA{R: 255, G: 255, B: 255, A: 255})
-	// 		content := container.NewStack(
-	// 			background,
-	// 			container.NewVBox(
-	// 				name,
-	// 				pubKey,
-	// 				ipv4,
-	// 				ipv6,
-	// 				createdAt,
-	// 			))
-	// 		return content
-	// 	},
-	// 	func(i widget.ListItemID, o fyne.CanvasObject) {
-	// 		background := o.(*fyne.Container).Objects[0].(*canvas.Rectangle)
-	// 		container := o.(*fyne.Container).Objects[1].(*fyne.Container)
+	// When the account is full the stale device has to go first to make room.
+	if staleRegistered && len(m.User.Devices) >= 5 {
+		err := m.Client.DeleteDevice(m.ctx, stalePubKey, mozToken)
+		if err != nil {
+			return fmt.Errorf("unable to remove stale device err:%w", err)
+		}
+		m.removeDeviceFromUser(stalePubKey)
+		staleRegistered = false
+	} else if !staleRegistered && len(m.User.Devices) >= 5 {
+		return ErrDeviceLimit
+	}
 
-	// 		if i >= len(m.User.Devices) {
-	// 			return
-	// 		}
+	err := m.registerDevice(mozToken)
+	if err != nil {
+		return fmt.Errorf("unable to register migrated device err:%w", err)
+	}
 
-	// 		nameLabel := container.Objects[0].(*widget.Label)
-	// 		// uniqueIdLabel := container.Objects[1].(*widget.Label)
-	// 		pubKeyLabel := container.Objects[1].(*widget.Label)
-	// 		ipv4Label := container.Objects[2].(*widget.Label)
-	// 		ipv6Label := container.Objects[3].(*widget.Label)
-	// 		createdAtLabel := container.Objects[4].(*widget.Label)
-
-	// 		deviceName := m.User.Devices[i].Name
-	// 		deviceUniqueId := m.User.Devices[i].UniqueID
-	// 		devicePubKey := m.User.Devices[i].Pubkey
-	// 		deviceIpv4 := m.User.Devices[i].IPv4Address
-	// 		deviceIpv6 := m.User.Devices[i].IPv6Address
-	// 		deviceCreatedAt := m.User.Devices[i].CreatedAt.String()
-
-	// 		if deviceUniqueId != nil && *deviceUniqueId != "" {
-	// 			nameLabel.SetText(fmt.Sprintf("%s (%s)", deviceName, *deviceUniqueId))
-	// 		} else {
-	// 			nameLabel.SetText(deviceName)
-	// 		}
-	// 		pubKeyLabel.SetText(devicePubKey)
-	// 		ipv4Label.SetText(deviceIpv4)
-	// 		ipv6Label.SetText(deviceIpv6)
-	// 		createdAtLabel.SetText(deviceCreatedAt)
-
-	// 		if pubKey == devicePubKey {
-	// 			background.FillColor = color.RGBA{R: 200, G: 225, B: 200, A: 255}
-	// 		} else {
-	// 			background.FillColor = color.RGBA{R: 255, G: 255, B: 255, A: 255}
-	// 		}
-	// 		background.Refresh()
-	// 	})
+	// The new keys are already saved, so the ed25519 pair that led here is
+	// gone. Remember the stale device instead of failing so it is not left
+	// holding a slot forever.
+	if staleRegistered {
+		m.App.Preferences().SetString("STALE_PUB_KEY", stalePubKey)
+		m.removeStaleDevice(mozToken)
+	}
+
+	return nil
+}
 
+// Retries removing a device left behind by a key migration.
+func (m *MozApp) removeStaleDevice(mozToken string) {
+	stalePubKey := m.App.Preferences().String("STALE_PUB_KEY")
+	if stalePubKey == "" {
+		return
+	}
+
+	registered := false
+	for _, d := range m.User.Devices {
+		if d.Pubkey == stalePubKey {
+			registered = true
+			break
+		}
+	}
+
+	if registered {
+		err := m.Client.DeleteDevice(m.ctx, stalePubKey, mozToken)
+		if err != nil {
+			log.Printf("Unable to remove stale device, trying again on next start err:%s\n", err)
+			return
+		}
+		m.removeDeviceFromUser(stalePubKey)
+	}
+	m.App.Preferences().RemoveValue("STALE_PUB_KEY")
+}
+
+func (m *MozApp) InitUi() error {
 	// relayList := widget.NewList(
 	// 	func() int {
 	// 		if m.relayList == nil {
@@ -294,98 +394,433 @@ func (m *MozApp) InitUi() error {
 	// 		labelRelayMultihopPort.SetText(fmt.Sprintf("%d", relayMultihopPort))
 	// 	})
 
+	// "Any" entries leave the field empty so Connect picks a relay itself.
+	// Relay options carry the latency, relayHosts maps them back to hostnames.
+	// Probes finish in the background, relayOptionsGen lets them tell whether
+	// the options they would relabel are still the ones on screen. Moving on
+	// to another city cancels the probes of the previous one.
+	var relayOptionsMu sync.Mutex
+	var relayOptionsGen uint64
+	var probeCancel context.CancelFunc
+	relayHosts := make(map[string]string)
+
 	selectRelay := widget.NewSelect([]string{}, func(value string) {
 		log.Println("Select relay", value)
-		m.selectState.Relay = value
+		relayOptionsMu.Lock()
+		hostname := relayHosts[value]
+		relayOptionsMu.Unlock()
+		m.setSelection(func(s *SelectState) {
+			s.Relay = hostname
+		})
 	})
+	// Old labels stay in relayHosts until the city changes, so a selection
+	// made before a relabel still maps to its relay.
+	relayOptions := func(city *City) []string {
+		options := []string{aNY_RELAY}
+		if city == nil {
+			return options
+		}
+		relays := make([]*Relay, 0, len(city.Relays))
+		for i := range city.Relays {
+			relays = append(relays, &city.Relays[i])
+		}
+		for _, r := range RankRelays(relays, m.latencyCache) {
+			label := m.relayLabel(r.Hostname)
+			relayHosts[label] = r.Hostname
+			options = append(options, label)
+		}
+		return options
+	}
+	probeCity := func(ctx context.Context, gen uint64, city *City) {
+		relays := make([]*Relay, 0, len(city.Relays))
+		for i := range city.Relays {
+			relays = append(relays, &city.Relays[i])
+		}
+		go func() {
+			ProbeRelays(ctx, m.prober, m.latencyCache, relays, pROBE_WORKERS, nil)
+
+			relayOptionsMu.Lock()
+			if gen != relayOptionsGen {
+				relayOptionsMu.Unlock()
+				return
+			}
+			options := relayOptions(city)
+			relayOptionsMu.Unlock()
+			// Only the labels change, the selection is left to the user.
+			selectRelay.SetOptions(options)
+		}()
+	}
 	selectCity := widget.NewSelect([]string{}, func(value string) {
 		log.Println("Select city", value)
-		m.selectState.City = value
-		for _, c1 := range m.relayList.Countries {
-			if c1.Name == m.selectState.Country {
-				for _, c2 := range c1.Cities {
-					if c2.Name == m.selectState.City {
-						relayList := make([]string, 0, len(c2.Relays))
-						for _, r := range c2.Relays {
-							relayList = append(relayList, r.Hostname)
-						}
-						fmt.Println("relayList", relayList)
-						selectRelay.SetOptions(relayList)
-						break
-					}
-				}
-				break
-			}
+		if value == aNY_CITY {
+			value = ""
+		}
+		var state SelectState
+		m.setSelection(func(s *SelectState) {
+			s.City = value
+			state = *s
+		})
+		city := m.relays().index.City(state.Country, state.City)
+
+		relayOptionsMu.Lock()
+		relayOptionsGen++
+		gen := relayOptionsGen
+		if probeCancel != nil {
+			probeCancel()
 		}
-		selectRelay.SetSelected("")
+		probeCtx, cancel := context.WithCancel(m.ctx)
+		probeCancel = cancel
+		relayHosts = make(map[string]string)
+		options := relayOptions(city)
+		relayOptionsMu.Unlock()
+
+		selectRelay.SetOptions(options)
+		selectRelay.SetSelected(aNY_RELAY)
 		selectRelay.Refresh()
+		if city != nil {
+			probeCity(probeCtx, gen, city)
+		}
 	})
-	countryList := make([]string, 0, len(m.relayList.Countries))
-	for _, c := range m.relayList.Countries {
-		countryList = append(countryList, c.Name)
-	}
-	selectCountry := widget.NewSelect(countryList, func(value string) {
+	selectCountry := widget.NewSelect([]string{}, func(value string) {
 		log.Println("Select country", value)
-		m.selectState.Country = value
-		for _, c1 := range m.relayList.Countries {
-			if c1.Name == m.selectState.Country {
-				cityList := make([]string, 0, len(c1.Cities))
-				for _, c2 := range c1.Cities {
-					cityList = append(cityList, c2.Name)
-				}
-				fmt.Println("cityList", cityList)
-				selectCity.SetOptions(cityList)
-				break
+		m.setSelection(func(s *SelectState) {
+			s.Country = value
+		})
+		cityList := []string{aNY_CITY}
+		if country := m.relays().index.Country(value); country != nil {
+			for _, c := range country.Cities {
+				cityList = append(cityList, c.Name)
 			}
 		}
-		selectCity.ClearSelected()
-		selectRelay.ClearSelected()
-		selectRelay.SetOptions([]string{})
+		selectCity.SetOptions(cityList)
+		selectCity.SetSelected(aNY_CITY)
 	})
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search relays, cities or countries")
+	searchEntry.OnSubmitted = func(query string) {
+		matches := m.relays().index.Search(query, 1)
+		if len(matches) == 0 {
+			return
+		}
+		selectCountry.SetSelected(matches[0].CountryName)
+		selectCity.SetSelected(matches[0].CityName)
+		selectRelay.SetSelected(m.relayLabel(matches[0].RelayHostname))
+	}
+	relayStatusLabel := widget.NewLabel("")
+
+	updateRelayOptions := func() {
+		relays := m.relays()
+		countryList := make([]string, 0, len(relays.list.GetCountries()))
+		for _, c := range relays.list.GetCountries() {
+			countryList = append(countryList, c.Name)
+		}
+		selectCountry.ClearSelected()
+		selectCountry.SetOptions(countryList)
+		selectCity.SetOptions([]string{})
+
+		selectRelay.PlaceHolder = "(Select one)"
+		if relays.list != nil && relays.list.FromSnapshot {
+			selectRelay.PlaceHolder = "Select a relay (possibly outdated)"
+		}
+		selectRelay.Refresh()
+		statusText := relays.list.StatusText()
+		if relays.fallback != nil {
+			statusText = fmt.Sprintf("%s. %s", relays.fallback, statusText)
+		}
+		if relays.report != nil && relays.report.Dropped > 0 {
+			statusText = fmt.Sprintf("%s, %d invalid relays skipped", statusText, relays.report.Dropped)
+		}
+		relayStatusLabel.SetText(statusText)
+	}
+
+	// Loading happens in the background so the window shows up straight away.
+	loadRelays := func(showError bool) {
+		relayStatusLabel.SetText("Loading server list...")
+		go func() {
+			err := m.LoadRelayList()
+			if errors.Is(err, errRelayLoadSuperseded) {
+				return
+			}
+			if err != nil {
+				log.Printf("Unable to load relay list err:%s\n", err)
+				if showError {
+					dialog.ShowError(err, m.Window)
+				}
+			}
+			updateRelayOptions()
+		}()
+	}
+	loadRelays(false)
+
+	switchRelaySource := func(name string) {
+		m.App.Preferences().SetString("RELAY_SOURCE", name)
+		loadRelays(true)
+	}
+
+	selectSource := widget.NewSelect(RelaySourceNames, nil)
+	selectSource.SetSelected(m.App.Preferences().StringWithFallback("RELAY_SOURCE", rELAY_SOURCE_MULLVAD))
+	selectSource.OnChanged = func(value string) {
+		if value != rELAY_SOURCE_FILE {
+			switchRelaySource(value)
+			return
+		}
+
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, m.Window)
+				return
+			}
+			if reader == nil {
+				return
+			}
+			reader.Close()
+
+			m.App.Preferences().SetString("RELAY_FILE", reader.URI().Path())
+			switchRelaySource(value)
+		}, m.Window)
+	}
+
 	serverContainer := container.New(layout.NewVBoxLayout(),
+		selectSource,
+		searchEntry,
 		selectCountry,
 		selectCity,
-		selectRelay)
+		selectRelay,
+		relayStatusLabel)
 
 	stateLabel := widget.NewLabel("Disconnected")
 	connectButton := widget.NewButton("Connect", nil)
-	connectButton.OnTapped = func() {
-		m.connected = !m.connected
-		if m.connected {
-			stateLabel.SetText("Connected")
+	quickConnectButton := widget.NewButton("Quick connect", nil)
+	updateConnectionState := func() {
+		connected, relay := m.connection()
+		if connected {
+			stateLabel.SetText(fmt.Sprintf("Connected to %s", relay))
 			connectButton.SetText("Disconnect")
 		} else {
 			stateLabel.SetText("Disconnected")
 			connectButton.SetText("Connect")
 		}
 	}
+	// Connecting waits for a handshake and may try several relays, so it
+	// runs in the background with the buttons disabled until it is done.
+	changeTunnel := func(status string, change func() error) {
+		connectButton.Disable()
+		quickConnectButton.Disable()
+		stateLabel.SetText(status)
+		go func() {
+			err := change()
+			if err != nil {
+				log.Printf("Unable to change tunnel state err:%s\n", err)
+				dialog.ShowError(err, m.Window)
+			}
+			updateConnectionState()
+			connectButton.Enable()
+			quickConnectButton.Enable()
+		}()
+	}
+	connectButton.OnTapped = func() {
+		if connected, _ := m.connection(); connected {
+			changeTunnel("Disconnecting...", m.Disconnect)
+		} else {
+			changeTunnel("Connecting...", m.Connect)
+		}
+	}
+
+	quickConnectButton.OnTapped = func() {
+		nearest, err := m.nearestCity()
+		if err != nil {
+			log.Printf("Unable to quick connect err:%s\n", err)
+			dialog.ShowError(err, m.Window)
+			return
+		}
+		// Selecting the city leaves the relay on "Any relay".
+		selectCountry.SetSelected(nearest.Country.Name)
+		selectCity.SetSelected(nearest.City.Name)
+		changeTunnel("Connecting...", func() error {
+			err := m.Disconnect()
+			if err != nil {
+				return err
+			}
+			return m.Connect()
+		})
+	}
+
+	homeEntry := widget.NewEntry()
+	homeEntry.SetPlaceHolder("Home location as latitude, longitude (optional)")
+	homeEntry.SetText(m.App.Preferences().String("HOME_LOCATION"))
+	homeEntry.OnSubmitted = func(value string) {
+		if strings.TrimSpace(value) == "" {
+			m.App.Preferences().RemoveValue("HOME_LOCATION")
+			return
+		}
+		home, err := ParseCoordinates(value)
+		if err != nil {
+			dialog.ShowError(err, m.Window)
+			return
+		}
+		m.App.Preferences().SetString("HOME_LOCATION", home.String())
+		homeEntry.SetText(home.String())
+	}
 
-	// _ = deviceList
 	// _ = relayList
 
-	// tabs := container.NewAppTabs(
-	// 	container.NewTabItemWithIcon("Home", theme.HomeIcon(), widget.NewLabel("Home")),
-	// 	container.NewTabItemWithIcon("Servers", theme.ComputerIcon(), serverContainer),
-	// 	container.NewTabItemWithIcon("Devices", theme.ComputerIcon(), deviceList),
-	// )
+	exportButton := widget.NewButton("Export wg-quick config", m.ExportWgQuickConfig)
 
 	topContainer := container.New(layout.NewVBoxLayout(),
 		serverContainer,
 		stateLabel,
 		connectButton,
+		quickConnectButton,
+		homeEntry,
+		exportButton,
 	)
 
-	m.Window.SetContent(topContainer)
+	deviceView := m.newDeviceView()
+	accountView := m.newAccountView(func() {
+		deviceView.Refresh()
+		if connected, _ := m.connection(); !connected {
+			stateLabel.SetText("Disconnected")
+			connectButton.SetText("Connect")
+		}
+	})
+
+	tabs := container.NewAppTabs(
+		container.NewTabItemWithIcon("Servers", theme.HomeIcon(), topContainer),
+		container.NewTabItemWithIcon("Devices", theme.ComputerIcon(), deviceView),
+		container.NewTabItemWithIcon("Account", theme.AccountIcon(), accountView),
+	)
+
+	m.Window.SetContent(tabs)
 	m.Window.ShowAndRun()
+	m.cancel()
+
+	if connected, _ := m.connection(); connected {
+		err := m.Disconnect()
+		if err != nil {
+			log.Printf("Unable to disconnect on exit err:%s\n", err)
+		}
+	}
+	return nil
+}
+
+func (m *MozApp) tunnelParts() (string, *Device, error) {
+	privKey, _ := m.GetKeys()
+	if privKey == "" {
+		return "", nil, fmt.Errorf("no private key stored for this device")
+	}
+
+	device := m.GetCurrentDevice()
+	if device == nil {
+		return "", nil, fmt.Errorf("this device is not registered with the account")
+	}
+	return privKey, device, nil
+}
+
+func (m *MozApp) tunnelConfig(relay *Relay, preferIPv6 bool) (*TunnelConfig, error) {
+	privKey, device, err := m.tunnelParts()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := NewTunnelConfig(privKey, device, relay, m.relays().list.WireGuard, preferIPv6)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tunnel config err:%s", err)
+	}
+	return config, nil
+}
+
+// With only a country or city selected a different relay is picked when one
+// does not answer the handshake. Failing to set up the tunnel locally is not
+// the relay's fault, so that ends the attempt straight away.
+func (m *MozApp) Connect() error {
+	m.tunnelMu.Lock()
+	defer m.tunnelMu.Unlock()
+	if connected, _ := m.connection(); connected {
+		return nil
+	}
+
+	attempts := 1
+	if m.selection().IsAny() {
+		attempts = rELAY_PICK_ATTEMPTS
+	}
+
+	tried := make(map[string]bool)
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		relay, err := m.selectedRelay(tried)
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		tried[relay.Hostname] = true
+
+		config, err := m.tunnelConfig(relay, false)
+		if err != nil {
+			return err
+		}
+
+		tunnel, err := StartTunnel(*config)
+		if err != nil {
+			return fmt.Errorf("unable to start tunnel to %s err:%s", relay.Hostname, err)
+		}
+
+		err = tunnel.WaitForHandshake(m.ctx, hANDSHAKE_TIMEOUT)
+		if err != nil {
+			closeErr := tunnel.Close()
+			if closeErr != nil {
+				log.Printf("Unable to close tunnel to %s err:%s\n", relay.Hostname, closeErr)
+			}
+			lastErr = fmt.Errorf("relay %s did not answer err:%s", relay.Hostname, err)
+			log.Println(lastErr)
+			continue
+		}
+
+		m.connMu.Lock()
+		m.tunnel = tunnel
+		m.connected = true
+		m.connectedRelay = relay.Hostname
+		m.connMu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+func (m *MozApp) Disconnect() error {
+	m.tunnelMu.Lock()
+	defer m.tunnelMu.Unlock()
+
+	m.connMu.Lock()
+	tunnel := m.tunnel
+	m.tunnel = nil
+	m.connected = false
+	m.connectedRelay = ""
+	m.connMu.Unlock()
+	if tunnel == nil {
+		return nil
+	}
+
+	err := tunnel.Close()
+	if err != nil {
+		return fmt.Errorf("unable to stop tunnel err:%s", err)
+	}
 	return nil
 }
 
+// Whether a tunnel is up and the relay it goes to.
+func (m *MozApp) connection() (bool, string) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	return m.connected, m.connectedRelay
+}
+
 func (m *MozApp) GetCurrentDevice() *Device {
 	if m.User == nil {
 		return nil
 	}
 
-	pubKey := m.App.Preferences().String("PUB_KEY")
+	_, pubKey := m.GetKeys()
 
 	if pubKey == "" {
 		return nil
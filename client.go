@@ -3,17 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
-
-	"github.com/pkg/browser"
 )
 
 type User struct {
@@ -64,6 +64,10 @@ type Relay struct {
 	IpV6AddrIn   string `json:"ipv6_addr_in"`
 	PubKey       string `json:"public_key"`
 	MultihopPort uint16 `json:"multihop_port"`
+	Active       bool   `json:"active"`
+	Weight       int    `json:"weight"`
+	Provider     string `json:"provider"`
+	Owned        bool   `json:"owned"`
 }
 
 type City struct {
@@ -80,8 +84,26 @@ type Country struct {
 	Cities []City `json:"cities"`
 }
 
+type WireGuardInfo struct {
+	PortRanges  [][2]uint16
+	IPv4Gateway string
+	IPv6Gateway string
+}
+
 type RelayList struct {
-	Countries []Country `json:"countries"`
+	Countries []Country     `json:"countries"`
+	WireGuard WireGuardInfo `json:"-"`
+
+	FetchedAt    time.Time `json:"-"`
+	FromCache    bool      `json:"-"`
+	FromSnapshot bool      `json:"-"`
+}
+
+func (r *RelayList) GetCountries() []Country {
+	if r == nil {
+		return nil
+	}
+	return r.Countries
 }
 
 type FlatRelay struct {
@@ -98,20 +120,85 @@ type FlatRelay struct {
 	RelayIpV6AddrIn   string
 	RelayPubKey       string
 	RelayMultihopPort uint16
+
+	Relay *Relay
+}
+
+type Endpoints struct {
+	BaseUrl   string
+	RelayList string
 }
 
 type MozClient struct {
-	client *http.Client
+	client     *http.Client
+	endpoints  Endpoints
+	retry      RetryPolicy
+	relayCache *RelayCache
 }
 
-var rELAY_LIST = "https://api.mullvad.net/public/relays/wireguard/v1/"
+var rELAY_LIST = "https://api.mullvad.net/app/v1/relays"
 var bASE_URL = "https://vpn.mozilla.org"
 var v1_API = "api/v1"
 var v2_API = "api/v2"
 
-func (m *MozClient) GetUser(mozToken string) (*User, error) {
-	requestUrl := fmt.Sprintf("%s/%s/vpn/account", bASE_URL, v1_API)
-	req, err := http.NewRequest("GET", requestUrl, nil)
+var DefaultEndpoints = Endpoints{
+	BaseUrl:   bASE_URL,
+	RelayList: rELAY_LIST,
+}
+
+// Lets the app be pointed at a staging environment or a local mock without
+// rebuilding.
+func EndpointsFromEnv() Endpoints {
+	endpoints := DefaultEndpoints
+	if baseUrl := os.Getenv("MOZ_VPN_BASE_URL"); baseUrl != "" {
+		endpoints.BaseUrl = strings.TrimSuffix(baseUrl, "/")
+	}
+	if relayList := os.Getenv("MOZ_VPN_RELAY_LIST"); relayList != "" {
+		endpoints.RelayList = relayList
+	}
+	return endpoints
+}
+
+// Used when the caller's context has no deadline of its own. The HTTP client
+// timeout is only a backstop for callers that pass a context without one.
+var aPI_TIMEOUT = 30 * time.Second
+var rELAY_LIST_TIMEOUT = 60 * time.Second
+var hTTP_TIMEOUT = 2 * time.Minute
+
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func NewMozClient(client *http.Client, endpoints Endpoints) *MozClient {
+	if client == nil {
+		client = &http.Client{Timeout: hTTP_TIMEOUT}
+	}
+	if endpoints.BaseUrl == "" {
+		endpoints.BaseUrl = DefaultEndpoints.BaseUrl
+	}
+	if endpoints.RelayList == "" {
+		endpoints.RelayList = DefaultEndpoints.RelayList
+	}
+	return &MozClient{
+		client:    client,
+		endpoints: endpoints,
+		retry:     DefaultRetryPolicy,
+	}
+}
+
+func (m *MozClient) apiUrl(version string, path string) string {
+	return fmt.Sprintf("%s/%s/%s", m.endpoints.BaseUrl, version, path)
+}
+
+func (m *MozClient) GetUser(ctx context.Context, mozToken string) (*User, error) {
+	ctx, cancel := withDefaultTimeout(ctx, aPI_TIMEOUT)
+	defer cancel()
+
+	requestUrl := m.apiUrl(v1_API, "vpn/account")
+	req, err := http.NewRequestWithContext(ctx, "GET", requestUrl, nil)
 	if err != nil {
 		return nil, fmt.Errorf("unable create GET request err:%s", err)
 	}
@@ -119,21 +206,14 @@ func (m *MozClient) GetUser(mozToken string) (*User, error) {
 	bearerAuth := fmt.Sprintf("Bearer %s", mozToken)
 	req.Header.Set("Authorization", bearerAuth)
 
-	res, err := m.client.Do(req)
+	res, err := m.do(req, true)
 	if err != nil {
 		return nil, fmt.Errorf("unable perform GET request err:%s", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		if res.Body != nil {
-			bodyStr, err := io.ReadAll(res.Body)
-			if err != nil {
-				return nil, fmt.Errorf("unable to get body from HTTP request err:%s", err)
-			}
-			log.Println("bodyStr", string(bodyStr))
-		}
-		return nil, fmt.Errorf("did not get HTTP 200 from request err:%s", err)
+		return nil, newAPIError(req, res)
 	}
 
 	body, err := io.ReadAll(res.Body)
@@ -150,15 +230,18 @@ func (m *MozClient) GetUser(mozToken string) (*User, error) {
 	return &user, nil
 }
 
-func (m *MozClient) verifyLogin(code string, verifier string) (*Root, error) {
+func (m *MozClient) verifyLogin(ctx context.Context, code string, verifier string) (*Root, error) {
+	ctx, cancel := withDefaultTimeout(ctx, aPI_TIMEOUT)
+	defer cancel()
+
 	postBody, _ := json.Marshal(map[string]string{
 		"code":          code,
 		"code_verifier": verifier,
 	})
 	postBuffer := bytes.NewBuffer(postBody)
 
-	requestUrl := fmt.Sprintf("%s/%s/vpn/login/verify", bASE_URL, v2_API)
-	req, err := http.NewRequest("POST", requestUrl, postBuffer)
+	requestUrl := m.apiUrl(v2_API, "vpn/login/verify")
+	req, err := http.NewRequestWithContext(ctx, "POST", requestUrl, postBuffer)
 	if err != nil {
 		return nil, fmt.Errorf("unable create POST request err:%s", err)
 	}
@@ -167,7 +250,7 @@ func (m *MozClient) verifyLogin(code string, verifier string) (*Root, error) {
 	req.Header.Set("User-Agent", "Fyne Moz VPN")
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := m.client.Do(req)
+	res, err := m.do(req, false)
 	if err != nil {
 		return nil, fmt.Errorf("unable perform POST request err:%s", err)
 
@@ -175,8 +258,7 @@ func (m *MozClient) verifyLogin(code string, verifier string) (*Root, error) {
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("did not get HTTP 200 from request err:%s", err)
-
+		return nil, newAPIError(req, res)
 	}
 
 	bodyBytes, err := io.ReadAll(res.Body)
@@ -194,70 +276,10 @@ func (m *MozClient) verifyLogin(code string, verifier string) (*Root, error) {
 	return &result, nil
 }
 
-func (m *MozClient) Login() (*Root, error) {
-	channel := make(chan *Root, 1)
-	verifier, browserUrl := createChallengeUrl()
-	server := m.startServer(verifier, channel)
-
-	err := browser.OpenURL(browserUrl)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open URL err:%s", err)
-	}
-
-	res := <-channel
-	server.Shutdown(context.TODO())
-	return res, nil
-}
-
-func (m *MozClient) createHandler(verifier string, channel chan<- *Root) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		queries := r.URL.Query()
-		code := queries.Get("code")
-		log.Println("Code", code)
+func (m *MozClient) UploadDevice(ctx context.Context, pubKey string, mozToken string) (*UploadRes, error) {
+	ctx, cancel := withDefaultTimeout(ctx, aPI_TIMEOUT)
+	defer cancel()
 
-		if code == "" {
-			return
-		}
-
-		result, err := m.verifyLogin(code, verifier)
-		if err != nil {
-			log.Printf("Unable to open URL err:%s\n", err)
-			return
-		}
-
-		channel <- result
-	}
-}
-
-func createChallengeUrl() (string, string) {
-	a := make([]byte, 32)
-	rand.Read(a)
-
-	b := base64.StdEncoding.EncodeToString(a)
-
-	s := sha256.New()
-	s.Write([]byte(b))
-	c := s.Sum(nil)
-
-	d := base64.StdEncoding.EncodeToString(c)
-
-	browserUrl := fmt.Sprintf(
-		"%s/%s/vpn/login/linux?code_challenge_method=S256&code_challenge=%s&port=%s",
-		bASE_URL,
-		v2_API,
-		d,
-		"9443")
-	return b, browserUrl
-}
-
-func (m *MozClient) startServer(verifier string, in chan<- *Root) *http.Server {
-	http.HandleFunc("/", m.createHandler(verifier, in))
-	server := &http.Server{Addr: ":9443", Handler: nil}
-	go server.ListenAndServe()
-	return server
-}
-
-func (m *MozClient) UploadDevice(pubKey string, mozToken string) (*UploadRes, error) {
 	postBody, err := json.Marshal(map[string]string{
 		"name":   "MozVPN",
 		"pubkey": pubKey,
@@ -267,8 +289,8 @@ func (m *MozClient) UploadDevice(pubKey string, mozToken string) (*UploadRes, er
 	}
 
 	postStr := bytes.NewBuffer(postBody)
-	requestUrl := fmt.Sprintf("%s/%s/vpn/device", bASE_URL, v1_API)
-	req, err := http.NewRequest("POST", requestUrl, postStr)
+	requestUrl := m.apiUrl(v1_API, "vpn/device")
+	req, err := http.NewRequestWithContext(ctx, "POST", requestUrl, postStr)
 	if err != nil {
 		return nil, fmt.Errorf("unable create POST request err:%s", err)
 	}
@@ -277,12 +299,16 @@ func (m *MozClient) UploadDevice(pubKey string, mozToken string) (*UploadRes, er
 	req.Header.Set("Authorization", bearerStr)
 	req.Header.Set("User-Agent", "Fyne Moz VPN")
 	req.Header.Set("Content-Type", "application/json")
-	res, err := m.client.Do(req)
+	res, err := m.do(req, false)
 	if err != nil {
 		return nil, fmt.Errorf("unable perform POST request err:%s", err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return nil, newAPIError(req, res)
+	}
+
 	bodyBytes, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get body from HTTP request err:%s", err)
@@ -297,80 +323,170 @@ func (m *MozClient) UploadDevice(pubKey string, mozToken string) (*UploadRes, er
 	return &result, nil
 }
 
-func (m *MozClient) GetRelayList() (*RelayList, error) {
-	req, err := http.NewRequest("GET", rELAY_LIST, nil)
+func (m *MozClient) DeleteDevice(ctx context.Context, pubKey string, mozToken string) error {
+	ctx, cancel := withDefaultTimeout(ctx, aPI_TIMEOUT)
+	defer cancel()
+
+	requestUrl := m.apiUrl(v1_API, "vpn/device/"+url.PathEscape(pubKey))
+	req, err := http.NewRequestWithContext(ctx, "DELETE", requestUrl, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable create GET request to %s err:%s", rELAY_LIST, err)
+		return fmt.Errorf("unable create DELETE request err:%s", err)
 	}
 
-	res, err := m.client.Do(req)
+	bearerStr := fmt.Sprintf("Bearer %s", mozToken)
+	req.Header.Set("Authorization", bearerStr)
+	req.Header.Set("User-Agent", "Fyne Moz VPN")
+	res, err := m.do(req, true)
 	if err != nil {
-		return nil, fmt.Errorf("unable perform GET request err:%s", err)
+		return fmt.Errorf("unable perform DELETE request err:%s", err)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		if res.Body != nil {
-			bodyStr, err := io.ReadAll(res.Body)
-			if err != nil {
-				return nil, fmt.Errorf("unable to get body from HTTP request to %s err:%s", rELAY_LIST, err)
-			}
-			log.Println("bodyStr", string(bodyStr))
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		return newAPIError(req, res)
+	}
+
+	return nil
+}
+
+// Guardian has no endpoint to revoke a token, so logging out only removes the
+// device when asked to. The token itself has to be forgotten by the caller.
+func (m *MozClient) Logout(ctx context.Context, pubKey string, mozToken string, removeDevice bool) error {
+	if !removeDevice || pubKey == "" || mozToken == "" {
+		return nil
+	}
+
+	err := m.DeleteDevice(ctx, pubKey, mozToken)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.IsUnauthorized() || apiErr.StatusCode == http.StatusNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to remove device err:%w", err)
+	}
+	return nil
+}
+
+func (m *MozClient) SetRelayCache(cache *RelayCache) {
+	m.relayCache = cache
+}
+
+// Revalidates the cached list with ETag/If-Modified-Since and falls back to it
+// when the relay server cannot be reached. The cached list is only decoded
+// when it is actually used.
+func (m *MozClient) GetRelayList(ctx context.Context) (*RelayList, error) {
+	relayListUrl := m.endpoints.RelayList
+
+	var meta *RelayCacheMeta
+	if m.relayCache != nil {
+		var err error
+		meta, err = m.relayCache.LoadMeta(relayListUrl)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Relay cache unavailable err:%s\n", err)
 		}
-		return nil, fmt.Errorf("did not get HTTP 200 from request to %s err:%s", rELAY_LIST, err)
 	}
 
-	body, err := io.ReadAll(res.Body)
+	relay, err := m.fetchRelayList(ctx, relayListUrl, meta)
+	if err == nil {
+		return relay, nil
+	}
+
+	if meta != nil {
+		cached, cacheErr := m.relayCache.LoadList(meta)
+		if cacheErr == nil {
+			log.Printf("Using cached relay list from %s err:%s\n", cached.FetchedAt, err)
+			cached.FromCache = true
+			return cached, nil
+		}
+		log.Printf("Relay cache unavailable err:%s\n", cacheErr)
+	}
+
+	snapshot, snapshotErr := loadRelaySnapshot()
+	if snapshotErr != nil {
+		log.Printf("Unable to use bundled relay list err:%s\n", snapshotErr)
+		return nil, err
+	}
+	log.Printf("Using bundled relay list from %s err:%s\n", snapshot.FetchedAt, err)
+	return snapshot, nil
+}
+
+func (m *MozClient) fetchRelayList(ctx context.Context, relayListUrl string, meta *RelayCacheMeta) (*RelayList, error) {
+	ctx, cancel := withDefaultTimeout(ctx, rELAY_LIST_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", relayListUrl, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get body from HTTP request to %s err:%s", rELAY_LIST, err)
+		return nil, fmt.Errorf("unable create GET request to %s err:%s", relayListUrl, err)
 	}
 
-	var relay RelayList
-	err = json.Unmarshal(body, &relay)
+	if meta != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	res, err := m.do(req, true)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse JSON as User obtained from %s err:%s", rELAY_LIST, err)
-	}
-
-	// result := make([]FlatRelay, 0)
-
-	// for _, c1 := range relay.Countries {
-	// 	countryName := c1.Name
-	// 	countryCode := c1.Code
-	// 	for _, c2 := range c1.Cities {
-	// 		cityName := c2.Name
-	// 		cityCode := c2.Code
-	// 		cityLatitude := c2.Latitude
-	// 		cityLongitude := c2.Longitude
-	// 		for _, r := range c2.Relays {
-	// 			relayHostname := r.Hostname
-	// 			relayIpv4AddrIn := r.IpV4AddrIn
-	// 			relayIpV6AddrIn := r.IpV6AddrIn
-	// 			relayPubKey := r.PubKey
-	// 			relayMultihopPort := r.MultihopPort
-
-	// 			flatRelay := FlatRelay{
-	// 				CountryName: countryName,
-	// 				CountryCode: countryCode,
-
-	// 				CityName:      cityName,
-	// 				CityCode:      cityCode,
-	// 				CityLatitude:  cityLatitude,
-	// 				CityLongitude: cityLongitude,
-
-	// 				RelayHostname:     relayHostname,
-	// 				RelayIpV4AddrIn:   relayIpv4AddrIn,
-	// 				RelayIpV6AddrIn:   relayIpV6AddrIn,
-	// 				RelayPubKey:       relayPubKey,
-	// 				RelayMultihopPort: relayMultihopPort,
-	// 			}
-
-	// 			result = append(result, flatRelay)
-
-	// 		}
-	// 	}
-	// }
-
-	// fmt.Println("len(result)", len(result))
-
-	return &relay, nil
+		return nil, fmt.Errorf("unable perform GET request err:%s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && meta != nil {
+		cached, err := m.relayCache.LoadList(meta)
+		if err != nil {
+			// The server thinks we have a copy, ask again without validators.
+			log.Printf("Unable to use cached relay list, downloading it again err:%s\n", err)
+			return m.fetchRelayList(ctx, relayListUrl, nil)
+		}
+		meta.FetchedAt = time.Now()
+		m.storeRelayCache(nil, *meta)
+		cached.FetchedAt = meta.FetchedAt
+		return cached, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, newAPIError(req, res)
+	}
+
+	// The cache is written while the list is decoded instead of buffering
+	// the whole body first.
+	body := io.Reader(res.Body)
+	writer := m.newRelayCacheWriter()
+	if writer != nil {
+		defer writer.Abort()
+		body = io.TeeReader(res.Body, writer)
+	}
+
+	relay, err := decodeRelayListStream(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JSON as RelayList obtained from %s err:%s", relayListUrl, err)
+	}
+	relay.FetchedAt = time.Now()
+
+	// A list that parses but has nothing usable must not replace the last
+	// good copy, GetRelayList falls back to it instead.
+	_, report := ValidateRelayList(relay)
+	if report.Kept == 0 {
+		return nil, fmt.Errorf("relay list obtained from %s has no usable relays, %s", relayListUrl, report)
+	}
+
+	if writer != nil {
+		// The decoder stops at the closing brace, copy whatever trails it too.
+		_, err = io.Copy(io.Discard, body)
+		if err == nil {
+			err = writer.Commit(RelayCacheMeta{
+				Url:          relayListUrl,
+				ETag:         res.Header.Get("ETag"),
+				LastModified: res.Header.Get("Last-Modified"),
+				FetchedAt:    relay.FetchedAt,
+			})
+		}
+		if err != nil {
+			log.Printf("Unable to update relay cache err:%s\n", err)
+		}
+	}
+
+	return relay, nil
 }
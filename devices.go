@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"log"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+var ErrDeviceLimit = errors.New("you need to remove some devices because Mozilla VPN only supports up to 5 public keys")
+
+func (m *MozApp) RemoveDevice(pubKey string) error {
+	mozToken := m.Token()
+
+	err := m.Client.DeleteDevice(m.ctx, pubKey, mozToken)
+	if err != nil {
+		return fmt.Errorf("unable to remove device err:%w", err)
+	}
+
+	user, err := m.Client.GetUser(m.ctx, mozToken)
+	if err != nil {
+		log.Printf("Unable to refresh user after removing device err:%s\n", err)
+		m.removeDeviceFromUser(pubKey)
+	} else {
+		m.User = user
+	}
+
+	// A freed slot lets this installation register itself if it could not
+	// do so at startup.
+	if m.GetCurrentDevice() == nil {
+		err = m.CheckDevice()
+		if err != nil {
+			return fmt.Errorf("unable to register this device err:%w", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *MozApp) newDeviceView() fyne.CanvasObject {
+	var deviceList *widget.List
+	deviceList = widget.NewList(
+		func() int {
+			if m.User == nil {
+				return 0
+			}
+			return len(m.User.Devices)
+		},
+		func() fyne.CanvasObject {
+			name := widget.NewLabel("")
+			pubKey := widget.NewLabel("")
+			ipv4 := widget.NewLabel("")
+			ipv6 := widget.NewLabel("")
+			createdAt := widget.NewLabel("")
+			removeButton := widget.NewButton("Remove", nil)
+
+			background := canvas.NewRectangle(color.RGBA{R: 255, G: 255, B: 255, A: 255})
+			content := container.NewStack(
+				background,
+				container.NewBorder(nil, nil, nil, removeButton,
+					container.NewVBox(
+						name,
+						pubKey,
+						ipv4,
+						ipv6,
+						createdAt,
+					)))
+			return content
+		},
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			if m.User == nil || i >= len(m.User.Devices) {
+				return
+			}
+
+			background := o.(*fyne.Container).Objects[0].(*canvas.Rectangle)
+			border := o.(*fyne.Container).Objects[1].(*fyne.Container)
+			labels := border.Objects[0].(*fyne.Container)
+			removeButton := border.Objects[1].(*widget.Button)
+
+			nameLabel := labels.Objects[0].(*widget.Label)
+			pubKeyLabel := labels.Objects[1].(*widget.Label)
+			ipv4Label := labels.Objects[2].(*widget.Label)
+			ipv6Label := labels.Objects[3].(*widget.Label)
+			createdAtLabel := labels.Objects[4].(*widget.Label)
+
+			device := m.User.Devices[i]
+			_, currPubKey := m.GetKeys()
+			isCurrent := device.Pubkey == currPubKey
+
+			deviceName := device.Name
+			if device.UniqueID != nil && *device.UniqueID != "" {
+				deviceName = fmt.Sprintf("%s (%s)", deviceName, *device.UniqueID)
+			}
+			if isCurrent {
+				deviceName = fmt.Sprintf("%s - this device", deviceName)
+			}
+			nameLabel.SetText(deviceName)
+			pubKeyLabel.SetText(device.Pubkey)
+			ipv4Label.SetText(device.IPv4Address)
+			ipv6Label.SetText(device.IPv6Address)
+			createdAtLabel.SetText(fmt.Sprintf("Created %s", device.CreatedAt.Local().Format("2006-01-02 15:04")))
+
+			if isCurrent {
+				background.FillColor = color.RGBA{R: 200, G: 225, B: 200, A: 255}
+				removeButton.Disable()
+			} else {
+				background.FillColor = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+				removeButton.Enable()
+			}
+			background.Refresh()
+
+			pubKey := device.Pubkey
+			removeButton.OnTapped = func() {
+				message := fmt.Sprintf("Remove %s from your account?", device.Name)
+				dialog.ShowConfirm("Remove device", message, func(ok bool) {
+					if !ok {
+						return
+					}
+					err := m.RemoveDevice(pubKey)
+					if err != nil {
+						log.Printf("Unable to remove device err:%s\n", err)
+						dialog.ShowError(err, m.Window)
+					}
+					deviceList.Refresh()
+				}, m.Window)
+			}
+		})
+
+	return deviceList
+}
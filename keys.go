@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuard keys are X25519 keys. The private key is clamped the same way
+// `wg genkey` does it so that it is interchangeable with the reference tools.
+func GenerateWgKeys() (string, string, error) {
+	privBytes := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(privBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read random bytes err:%s", err)
+	}
+
+	clampPrivateKey(privBytes)
+
+	pubBytes, err := curve25519.X25519(privBytes, curve25519.Basepoint)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to derive public key err:%s", err)
+	}
+
+	privKey := base64.StdEncoding.EncodeToString(privBytes)
+	pubKey := base64.StdEncoding.EncodeToString(pubBytes)
+	return privKey, pubKey, nil
+}
+
+func wgPublicKey(privKey string) (string, error) {
+	privBytes, err := base64.StdEncoding.DecodeString(privKey)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode key err:%s", err)
+	}
+	if len(privBytes) != curve25519.ScalarSize {
+		return "", fmt.Errorf("key is %d bytes but WireGuard keys are %d bytes", len(privBytes), curve25519.ScalarSize)
+	}
+
+	pubBytes, err := curve25519.X25519(privBytes, curve25519.Basepoint)
+	if err != nil {
+		return "", fmt.Errorf("unable to derive public key err:%s", err)
+	}
+	return base64.StdEncoding.EncodeToString(pubBytes), nil
+}
+
+func clampPrivateKey(key []byte) {
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+}
+
+// Earlier versions stored crypto/ed25519 keys, whose private key is the
+// 32 byte seed followed by the 32 byte public key.
+func isEd25519KeyPair(privKey string, pubKey string) bool {
+	privBytes, err := base64.StdEncoding.DecodeString(privKey)
+	if err != nil || len(privBytes) != 64 {
+		return false
+	}
+	pubBytes, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil || len(pubBytes) != 32 {
+		return false
+	}
+	return bytes.Equal(privBytes[32:], pubBytes)
+}
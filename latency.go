@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var pROBE_PORT uint16 = 443
+var pROBE_TIMEOUT = 2 * time.Second
+var pROBE_WORKERS = 8
+var lATENCY_CACHE_TTL = 5 * time.Minute
+
+// Measures the round trip time to a relay.
+type RelayProber interface {
+	Probe(ctx context.Context, relay *Relay) (time.Duration, error)
+}
+
+// Times a TCP connect to the relay. A refused connection still means the
+// relay answered, so it counts as a successful probe. This needs no keys,
+// unlike a WireGuard handshake initiation.
+type TCPProber struct {
+	Port    uint16
+	Timeout time.Duration
+}
+
+func (p *TCPProber) Probe(ctx context.Context, relay *Relay) (time.Duration, error) {
+	addr, err := netip.ParseAddr(relay.IpV4AddrIn)
+	if err != nil {
+		return 0, fmt.Errorf("relay %s has no usable IPv4 address err:%s", relay.Hostname, err)
+	}
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", netip.AddrPortFrom(addr, p.Port).String())
+	rtt := time.Since(start)
+	if err == nil {
+		conn.Close()
+		return rtt, nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return rtt, nil
+	}
+	return 0, err
+}
+
+type LatencyResult struct {
+	RTT      time.Duration
+	Err      error
+	ProbedAt time.Time
+}
+
+func (r LatencyResult) String() string {
+	if r.Err != nil {
+		return "no reply"
+	}
+	return fmt.Sprintf("%d ms", r.RTT.Milliseconds())
+}
+
+// Results by hostname, so reopening a city does not probe it again.
+type LatencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	results map[string]LatencyResult
+}
+
+func NewLatencyCache(ttl time.Duration) *LatencyCache {
+	return &LatencyCache{ttl: ttl, results: make(map[string]LatencyResult)}
+}
+
+func (c *LatencyCache) Get(hostname string) (LatencyResult, bool) {
+	if c == nil {
+		return LatencyResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, ok := c.results[hostname]
+	if !ok || time.Since(result.ProbedAt) > c.ttl {
+		return LatencyResult{}, false
+	}
+	return result, true
+}
+
+func (c *LatencyCache) Put(hostname string, result LatencyResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[hostname] = result
+}
+
+// Probes relays with at most workers probes in flight. Relays with a fresh
+// cached result are skipped, and nothing is cached once ctx is done. onResult
+// is called from the worker goroutines.
+func ProbeRelays(ctx context.Context, prober RelayProber, cache *LatencyCache, relays []*Relay, workers int, onResult func(relay *Relay, result LatencyResult)) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *Relay)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relay := range jobs {
+				rtt, err := prober.Probe(ctx, relay)
+				if ctx.Err() != nil {
+					// Cut short, not a relay that failed to reply.
+					continue
+				}
+				result := LatencyResult{RTT: rtt, Err: err, ProbedAt: time.Now()}
+				cache.Put(relay.Hostname, result)
+				if onResult != nil {
+					onResult(relay, result)
+				}
+			}
+		}()
+	}
+
+	for _, relay := range relays {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := cache.Get(relay.Hostname); ok {
+			continue
+		}
+		select {
+		case jobs <- relay:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Orders relays by cached latency, fastest first. Relays without a result or
+// that did not reply keep their order at the end.
+func RankRelays(relays []*Relay, cache *LatencyCache) []*Relay {
+	ranked := make([]*Relay, len(relays))
+	copy(ranked, relays)
+
+	rtt := func(r *Relay) (time.Duration, bool) {
+		result, ok := cache.Get(r.Hostname)
+		return result.RTT, ok && result.Err == nil
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, aOk := rtt(ranked[i])
+		b, bOk := rtt(ranked[j])
+		if aOk != bOk {
+			return aOk
+		}
+		return aOk && a < b
+	})
+	return ranked
+}
+
+// Hostname with the cached latency, as shown in the relay select.
+func (m *MozApp) relayLabel(hostname string) string {
+	result, ok := m.latencyCache.Get(hostname)
+	if !ok {
+		return hostname
+	}
+	return fmt.Sprintf("%s (%s)", hostname, result)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func localRelay(t *testing.T, accept bool) (*Relay, uint16) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%s", err)
+	}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	if accept {
+		t.Cleanup(func() { listener.Close() })
+	} else {
+		// Nothing listens on the port any more, so connects are refused.
+		listener.Close()
+	}
+	return &Relay{Hostname: "local-wg-001", IpV4AddrIn: "127.0.0.1"}, port
+}
+
+func TestTCPProberAccepted(t *testing.T) {
+	relay, port := localRelay(t, true)
+	prober := &TCPProber{Port: port, Timeout: time.Second}
+
+	rtt, err := prober.Probe(context.Background(), relay)
+	if err != nil || rtt <= 0 {
+		t.Errorf("got rtt:%s err:%v, want a round trip time", rtt, err)
+	}
+}
+
+func TestTCPProberRefused(t *testing.T) {
+	relay, port := localRelay(t, false)
+	prober := &TCPProber{Port: port, Timeout: time.Second}
+
+	_, err := prober.Probe(context.Background(), relay)
+	if err != nil {
+		t.Errorf("a refused connection should count as a reply, got err:%s", err)
+	}
+}
+
+func TestTCPProberTimeout(t *testing.T) {
+	relay, port := localRelay(t, true)
+	prober := &TCPProber{Port: port, Timeout: time.Nanosecond}
+
+	_, err := prober.Probe(context.Background(), relay)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got err:%v, want a timeout", err)
+	}
+}
+
+type fakeProber struct {
+	rtt      map[string]time.Duration
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+	probed   sync.Map
+}
+
+func (p *fakeProber) Probe(ctx context.Context, relay *Relay) (time.Duration, error) {
+	n := p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	for {
+		max := p.maxSeen.Load()
+		if n <= max || p.maxSeen.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	p.probed.Store(relay.Hostname, true)
+
+	time.Sleep(5 * time.Millisecond)
+	rtt, ok := p.rtt[relay.Hostname]
+	if !ok {
+		return 0, errors.New("no reply")
+	}
+	return rtt, nil
+}
+
+func testRelays(hostnames ...string) []*Relay {
+	relays := make([]*Relay, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		relays = append(relays, &Relay{Hostname: hostname})
+	}
+	return relays
+}
+
+func hostnames(relays []*Relay) []string {
+	names := make([]string, 0, len(relays))
+	for _, r := range relays {
+		names = append(names, r.Hostname)
+	}
+	return names
+}
+
+func TestProbeRelays(t *testing.T) {
+	prober := &fakeProber{rtt: map[string]time.Duration{
+		"a": 30 * time.Millisecond,
+		"b": 10 * time.Millisecond,
+		"c": 20 * time.Millisecond,
+	}}
+	cache := NewLatencyCache(time.Minute)
+	cache.Put("cached", LatencyResult{RTT: time.Millisecond, ProbedAt: time.Now()})
+	relays := testRelays("a", "b", "c", "d", "e", "f", "cached")
+
+	var results atomic.Int32
+	ProbeRelays(context.Background(), prober, cache, relays, 2, func(relay *Relay, result LatencyResult) {
+		results.Add(1)
+	})
+
+	if results.Load() != 6 {
+		t.Errorf("got %d results, want 6", results.Load())
+	}
+	if _, ok := prober.probed.Load("cached"); ok {
+		t.Error("relay with a fresh cached result was probed again")
+	}
+	if prober.maxSeen.Load() > 2 {
+		t.Errorf("got %d probes in flight, want at most 2", prober.maxSeen.Load())
+	}
+	if result, ok := cache.Get("d"); !ok || result.Err == nil {
+		t.Errorf("got %+v cached for d, want a failed probe", result)
+	}
+}
+
+func TestProbeRelaysCancelled(t *testing.T) {
+	prober := &fakeProber{}
+	cache := NewLatencyCache(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ProbeRelays(ctx, prober, cache, testRelays("a", "b"), 2, nil)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("a cancelled probe was cached")
+	}
+}
+
+func TestRankRelays(t *testing.T) {
+	cache := NewLatencyCache(time.Minute)
+	now := time.Now()
+	cache.Put("slow", LatencyResult{RTT: 30 * time.Millisecond, ProbedAt: now})
+	cache.Put("fast", LatencyResult{RTT: 10 * time.Millisecond, ProbedAt: now})
+	cache.Put("down", LatencyResult{Err: errors.New("no reply"), ProbedAt: now})
+	cache.Put("stale", LatencyResult{RTT: time.Millisecond, ProbedAt: now.Add(-time.Hour)})
+
+	relays := testRelays("down", "unprobed", "slow", "stale", "fast")
+	got := hostnames(RankRelays(relays, cache))
+	want := []string{"fast", "slow", "down", "unprobed", "stale"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if relays[0].Hostname != "down" {
+		t.Error("RankRelays reordered its input")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var hOME_LOCATION_ENV = "MOZ_VPN_HOME_LOCATION"
+var eARTH_RADIUS_KM = 6371.0
+
+type Coordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+func (c Coordinates) String() string {
+	return fmt.Sprintf("%.4f, %.4f", c.Latitude, c.Longitude)
+}
+
+// Accepts "latitude, longitude" in decimal degrees.
+func ParseCoordinates(value string) (Coordinates, error) {
+	latText, lonText, ok := strings.Cut(value, ",")
+	if !ok {
+		return Coordinates{}, fmt.Errorf("expected latitude, longitude but got %q", value)
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return Coordinates{}, fmt.Errorf("invalid latitude %q", latText)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(lonText), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return Coordinates{}, fmt.Errorf("invalid longitude %q", lonText)
+	}
+	return Coordinates{Latitude: lat, Longitude: lon}, nil
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Great-circle distance using the haversine formula.
+func (c Coordinates) DistanceKm(other Coordinates) float64 {
+	lat1 := radians(c.Latitude)
+	lat2 := radians(other.Latitude)
+	dLat := lat2 - lat1
+	dLon := radians(other.Longitude - c.Longitude)
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * eARTH_RADIUS_KM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+type CityDistance struct {
+	Country    *Country
+	City       *City
+	DistanceKm float64
+}
+
+func hasActiveRelay(city *City) bool {
+	for _, r := range city.Relays {
+		if r.Active {
+			return true
+		}
+	}
+	return false
+}
+
+// Cities with an active relay, closest first. Cities without coordinates are
+// left out since their distance would be meaningless.
+func (r *RelayList) NearestCities(home Coordinates) []CityDistance {
+	result := make([]CityDistance, 0)
+	for i := range r.GetCountries() {
+		country := &r.Countries[i]
+		for j := range country.Cities {
+			city := &country.Cities[j]
+			if (city.Latitude == 0 && city.Longitude == 0) || !hasActiveRelay(city) {
+				continue
+			}
+			result = append(result, CityDistance{
+				Country:    country,
+				City:       city,
+				DistanceKm: home.DistanceKm(Coordinates{Latitude: city.Latitude, Longitude: city.Longitude}),
+			})
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].DistanceKm < result[j].DistanceKm
+	})
+	return result
+}
+
+func (r *RelayList) NearestCity(home Coordinates) *CityDistance {
+	cities := r.NearestCities(home)
+	if len(cities) == 0 {
+		return nil
+	}
+	return &cities[0]
+}
+
+// Rough latitude of where people in each tz database area live.
+var tIMEZONE_AREA_LATITUDE = map[string]float64{
+	"Africa":     5,
+	"America":    35,
+	"Antarctica": -75,
+	"Asia":       30,
+	"Atlantic":   35,
+	"Australia":  -30,
+	"Europe":     50,
+	"Indian":     -10,
+	"Pacific":    -15,
+}
+
+// $TZ wins over /etc/localtime, as it does for the time package.
+func timezoneName() string {
+	name := strings.TrimPrefix(os.Getenv("TZ"), ":")
+	if name != "" {
+		return name
+	}
+
+	target, err := filepath.EvalSymlinks("/etc/localtime")
+	if err != nil {
+		return ""
+	}
+	_, name, ok := strings.Cut(target, "zoneinfo/")
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// The UTC offset gives the longitude to within a time zone, the tz area a
+// rough latitude. Good enough to find the nearest relay city.
+func EstimateHomeLocation(now time.Time) Coordinates {
+	_, offset := now.Zone()
+	lon := float64(offset) / 3600 * 15
+	lon = math.Max(-180, math.Min(180, lon))
+
+	area, _, _ := strings.Cut(timezoneName(), "/")
+	return Coordinates{Latitude: tIMEZONE_AREA_LATITUDE[area], Longitude: lon}
+}
+
+// Returns the configured home location, falling back to an estimate from the
+// time zone. The second value says where the location came from.
+func (m *MozApp) HomeLocation() (Coordinates, string) {
+	value := os.Getenv(hOME_LOCATION_ENV)
+	source := hOME_LOCATION_ENV
+	if value == "" {
+		value = m.App.Preferences().String("HOME_LOCATION")
+		source = "settings"
+	}
+
+	if value != "" {
+		home, err := ParseCoordinates(value)
+		if err == nil {
+			return home, source
+		}
+		log.Printf("Unable to use home location from %s err:%s\n", source, err)
+	}
+	return EstimateHomeLocation(time.Now()), "time zone"
+}
+
+func (m *MozApp) nearestCity() (*CityDistance, error) {
+	relayList := m.relays().list
+	if relayList == nil {
+		return nil, fmt.Errorf("relay list is not available")
+	}
+
+	home, source := m.HomeLocation()
+	nearest := relayList.NearestCity(home)
+	if nearest == nil {
+		return nil, fmt.Errorf("relay list has no cities with a location")
+	}
+	log.Printf("Nearest city to %s (from %s) is %s, %s at %.0f km\n", home, source, nearest.City.Name, nearest.Country.Name, nearest.DistanceKm)
+	return nearest, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/browser"
+)
+
+var lOGIN_TIMEOUT = 5 * time.Minute
+var lOGIN_LISTEN_ADDR = "127.0.0.1:0"
+
+type loginChallenge struct {
+	verifier   string
+	state      string
+	browserUrl string
+}
+
+type loginResult struct {
+	root *Root
+	err  error
+}
+
+func sendLoginResult(channel chan<- loginResult, result loginResult) {
+	select {
+	case channel <- result:
+	default:
+		// A result has already been delivered, later callbacks are ignored.
+	}
+}
+
+// Opens the login page in the browser. When that fails, e.g. because no
+// browser is installed, it falls back to the flow of LoginHeadless on in and
+// out instead of giving up.
+func (m *MozClient) Login(ctx context.Context, in io.Reader, out io.Writer) (*Root, error) {
+	return m.runLogin(ctx, func(ctx context.Context, challenge *loginChallenge, port int, channel chan<- loginResult) error {
+		err := browser.OpenURL(challenge.browserUrl)
+		if err != nil {
+			log.Printf("Unable to open URL, continuing with a pasted login err:%s\n", err)
+			return m.startPastedLogin(ctx, in, out, challenge, port, channel)
+		}
+		return nil
+	})
+}
+
+// Used where no browser can be opened, e.g. over SSH. The user either forwards
+// the callback port to the machine with the browser or pastes the redirect.
+func (m *MozClient) LoginHeadless(ctx context.Context, in io.Reader, out io.Writer) (*Root, error) {
+	return m.runLogin(ctx, func(ctx context.Context, challenge *loginChallenge, port int, channel chan<- loginResult) error {
+		return m.startPastedLogin(ctx, in, out, challenge, port, channel)
+	})
+}
+
+func (m *MozClient) startPastedLogin(ctx context.Context, in io.Reader, out io.Writer, challenge *loginChallenge, port int, channel chan<- loginResult) error {
+	fmt.Fprintf(out, "Open this URL in a browser to log in to Mozilla VPN:\n\n  %s\n\n", challenge.browserUrl)
+	fmt.Fprintf(out, "If the browser runs on another machine, either forward the callback port first:\n\n  ssh -L %d:127.0.0.1:%d <this host>\n\n", port, port)
+	fmt.Fprintf(out, "or paste the address the browser was redirected to (or just the code) here:\n")
+
+	go m.readPastedLogin(ctx, in, out, challenge, channel)
+	return nil
+}
+
+var pastedLinesMu sync.Mutex
+var pastedLines = map[io.Reader]chan string{}
+
+// Reading from in cannot be interrupted, so every login shares one reader per
+// input that lives until EOF. A login only takes lines while it runs, a line
+// can no longer be swallowed by an earlier attempt that has given up.
+func sharedLines(in io.Reader) <-chan string {
+	pastedLinesMu.Lock()
+	defer pastedLinesMu.Unlock()
+
+	lines, ok := pastedLines[in]
+	if ok {
+		return lines
+	}
+	lines = make(chan string)
+	pastedLines[in] = lines
+
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		err := scanner.Err()
+		if err != nil {
+			log.Printf("Unable to read pasted login err:%s\n", err)
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+func (m *MozClient) runLogin(ctx context.Context, start func(ctx context.Context, challenge *loginChallenge, port int, channel chan<- loginResult) error) (*Root, error) {
+	ctx, cancel := context.WithTimeout(ctx, lOGIN_TIMEOUT)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", lOGIN_LISTEN_ADDR)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for login callback err:%s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	challenge, err := m.createChallengeUrl(port)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	channel := make(chan loginResult, 1)
+	server := m.startServer(listener, challenge, channel)
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err = start(ctx, challenge, port, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-channel:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.root, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("login did not complete err:%w", ctx.Err())
+	}
+}
+
+func (m *MozClient) readPastedLogin(ctx context.Context, in io.Reader, out io.Writer, challenge *loginChallenge, channel chan<- loginResult) {
+	lines := sharedLines(in)
+	for {
+		var line string
+		select {
+		case <-ctx.Done():
+			return
+		case text, ok := <-lines:
+			if !ok {
+				return
+			}
+			line = strings.TrimSpace(text)
+		}
+		if line == "" {
+			continue
+		}
+
+		code := line
+		if strings.Contains(line, "?") {
+			pasted, err := url.Parse(line)
+			if err != nil {
+				fmt.Fprintf(out, "Unable to parse the pasted address err:%s\n", err)
+				continue
+			}
+
+			queries := pasted.Query()
+			if serverErr := queries.Get("error"); serverErr != "" {
+				sendLoginResult(channel, loginResult{err: fmt.Errorf("login was rejected by the server err:%s", serverErr)})
+				return
+			}
+
+			state := queries.Get("state")
+			if subtle.ConstantTimeCompare([]byte(state), []byte(challenge.state)) != 1 {
+				fmt.Fprintln(out, "The pasted address belongs to a different login attempt, please use the URL printed above")
+				continue
+			}
+
+			code = queries.Get("code")
+			if code == "" {
+				fmt.Fprintln(out, "The pasted address does not contain a login code")
+				continue
+			}
+		}
+
+		result, err := m.verifyLogin(ctx, code, challenge.verifier)
+		if err != nil {
+			sendLoginResult(channel, loginResult{err: fmt.Errorf("unable to verify login err:%w", err)})
+			return
+		}
+
+		fmt.Fprintln(out, "Login succeeded")
+		sendLoginResult(channel, loginResult{root: result})
+		return
+	}
+}
+
+func (m *MozClient) createHandler(challenge *loginChallenge, channel chan<- loginResult) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		queries := r.URL.Query()
+		code := queries.Get("code")
+		serverErr := queries.Get("error")
+
+		if code == "" && serverErr == "" {
+			writeLoginFailure(w, http.StatusBadRequest, "The login callback did not include a login code. Please try logging in again from the app.", "")
+			return
+		}
+
+		state := queries.Get("state")
+		if subtle.ConstantTimeCompare([]byte(state), []byte(challenge.state)) != 1 {
+			log.Println("Ignoring login callback with a mismatched state")
+			writeLoginFailure(w, http.StatusForbidden, "This login request was not started by this app.", "")
+			return
+		}
+
+		if serverErr != "" {
+			detail := serverErr
+			if description := queries.Get("error_description"); description != "" {
+				detail = fmt.Sprintf("%s: %s", serverErr, description)
+			}
+			log.Printf("Login was rejected by the server err:%s\n", detail)
+			writeLoginFailure(w, http.StatusBadRequest, "Mozilla rejected the login.", detail)
+			sendLoginResult(channel, loginResult{err: fmt.Errorf("login was rejected by the server err:%s", detail)})
+			return
+		}
+
+		result, err := m.verifyLogin(r.Context(), code, challenge.verifier)
+		if err != nil {
+			log.Printf("Unable to verify login err:%s\n", err)
+			writeLoginFailure(w, http.StatusBadGateway, "The login code could not be verified with Mozilla.", err.Error())
+			sendLoginResult(channel, loginResult{err: fmt.Errorf("unable to verify login err:%w", err)})
+			return
+		}
+
+		writeLoginSuccess(w)
+		sendLoginResult(channel, loginResult{root: result})
+	}
+}
+
+func randomUrlString() (string, error) {
+	a := make([]byte, 32)
+	_, err := rand.Read(a)
+	if err != nil {
+		return "", fmt.Errorf("unable to read random bytes err:%s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(a), nil
+}
+
+// Follows RFC 7636: the verifier is 43 characters of base64url and the S256
+// challenge is the unpadded base64url SHA-256 of it.
+func (m *MozClient) createChallengeUrl(port int) (*loginChallenge, error) {
+	verifier, err := randomUrlString()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create verifier err:%s", err)
+	}
+
+	state, err := randomUrlString()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create state err:%s", err)
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	queries := url.Values{}
+	queries.Set("code_challenge_method", "S256")
+	queries.Set("code_challenge", challenge)
+	queries.Set("port", fmt.Sprint(port))
+	queries.Set("state", state)
+
+	return &loginChallenge{
+		verifier:   verifier,
+		state:      state,
+		browserUrl: fmt.Sprintf("%s?%s", m.apiUrl(v2_API, "vpn/login/linux"), queries.Encode()),
+	}, nil
+}
+
+func (m *MozClient) startServer(listener net.Listener, challenge *loginChallenge, channel chan<- loginResult) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.createHandler(challenge, channel))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sendLoginResult(channel, loginResult{err: fmt.Errorf("login callback server failed err:%s", err)})
+		}
+	}()
+	return server
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPastedLoginAfterAbandonedLogin(t *testing.T) {
+	codes := make(chan string, 2)
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		codes <- body["code"]
+		json.NewEncoder(w).Encode(Root{Token: "token-" + body["code"]})
+	})
+
+	in, paste := io.Pipe()
+	defer paste.Close()
+
+	// The first login times out while waiting for a line to be pasted.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.LoginHeadless(ctx, in, io.Discard)
+	if err == nil {
+		t.Fatal("expected the first login to time out")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan loginResult, 1)
+	go func() {
+		root, err := client.LoginHeadless(ctx, in, io.Discard)
+		done <- loginResult{root: root, err: err}
+	}()
+
+	_, err = io.WriteString(paste, "second\n")
+	if err != nil {
+		t.Fatalf("paste err:%s", err)
+	}
+
+	result := <-done
+	if result.err != nil {
+		t.Fatalf("second login err:%s", result.err)
+	}
+	if result.root.Token != "token-second" {
+		t.Errorf("got token %q, want token-second", result.root.Token)
+	}
+	if len(codes) != 1 {
+		t.Errorf("got %d verify requests, want 1", len(codes))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+var loginPageTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Mozilla VPN - {{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #f9f9fa; color: #20123a; display: flex; justify-content: center; margin-top: 15vh; }
+main { max-width: 32em; padding: 2em; background: #fff; border-radius: 8px; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.1); }
+h1 { font-size: 1.4em; }
+.failure h1 { color: #d70022; }
+.success h1 { color: #058b00; }
+</style>
+</head>
+<body>
+<main class="{{if .Success}}success{{else}}failure{{end}}">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Detail}}<p><code>{{.Detail}}</code></p>{{end}}
+</main>
+</body>
+</html>
+`))
+
+type loginPage struct {
+	Success bool
+	Title   string
+	Message string
+	Detail  string
+}
+
+func writeLoginPage(w http.ResponseWriter, status int, page loginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := loginPageTemplate.Execute(w, page)
+	if err != nil {
+		log.Printf("Unable to write login page err:%s\n", err)
+	}
+}
+
+func writeLoginSuccess(w http.ResponseWriter) {
+	writeLoginPage(w, http.StatusOK, loginPage{
+		Success: true,
+		Title:   "Login succeeded",
+		Message: "You are now logged in to Mozilla VPN. You can close this tab and return to the app.",
+	})
+}
+
+func writeLoginFailure(w http.ResponseWriter, status int, message string, detail string) {
+	writeLoginPage(w, status, loginPage{
+		Success: false,
+		Title:   "Login failed",
+		Message: message,
+		Detail:  detail,
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 )
 
@@ -14,7 +15,9 @@ func main() {
 
 	err = mozApp.CheckDevice()
 
-	if err != nil {
+	if errors.Is(err, ErrDeviceLimit) {
+		log.Println("Device limit reached, remove a device from the Devices tab")
+	} else if err != nil {
 		log.Fatalf("Unable to register device err:%s\n", err)
 	}
 
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var cACHE_DIR_NAME = "fyne-moz-vpn"
+var rELAY_CACHE_FILE = "relays.json"
+var rELAY_CACHE_META_FILE = "relays.meta.json"
+
+type RelayCacheMeta struct {
+	Url          string    `json:"url"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+type RelayCache struct {
+	dir string
+}
+
+// On Linux os.UserCacheDir honours $XDG_CACHE_HOME and falls back to ~/.cache.
+func NewRelayCache() (*RelayCache, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find cache directory err:%s", err)
+	}
+	return &RelayCache{dir: filepath.Join(cacheDir, cACHE_DIR_NAME)}, nil
+}
+
+// Only the metadata is needed to revalidate, the list itself is decoded with
+// LoadList when the server says it is unchanged or cannot be reached.
+func (c *RelayCache) LoadMeta(url string) (*RelayCacheMeta, error) {
+	metaBytes, err := os.ReadFile(filepath.Join(c.dir, rELAY_CACHE_META_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read relay cache metadata err:%w", err)
+	}
+
+	var meta RelayCacheMeta
+	err = json.Unmarshal(metaBytes, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse relay cache metadata err:%s", err)
+	}
+	if meta.Url != url {
+		return nil, fmt.Errorf("relay cache holds %s instead of %s", meta.Url, url)
+	}
+	return &meta, nil
+}
+
+func (c *RelayCache) LoadList(meta *RelayCacheMeta) (*RelayList, error) {
+	file, err := os.Open(filepath.Join(c.dir, rELAY_CACHE_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read relay cache err:%w", err)
+	}
+	defer file.Close()
+
+	relay, err := decodeRelayListStream(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse relay cache err:%s", err)
+	}
+	relay.FetchedAt = meta.FetchedAt
+	return relay, nil
+}
+
+func (c *RelayCache) Store(body []byte, meta RelayCacheMeta) error {
+	err := os.MkdirAll(c.dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("unable to create cache directory err:%s", err)
+	}
+
+	if body != nil {
+		err = writeFileAtomic(filepath.Join(c.dir, rELAY_CACHE_FILE), body)
+		if err != nil {
+			return err
+		}
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("unable to marshal relay cache metadata err:%s", err)
+	}
+	return writeFileAtomic(filepath.Join(c.dir, rELAY_CACHE_META_FILE), metaBytes)
+}
+
+// Receives the relay list while it is being decoded so the body never has to
+// be buffered. Nothing replaces the cache until Commit.
+type RelayCacheWriter struct {
+	cache *RelayCache
+	tmp   *os.File
+	err   error
+}
+
+func (c *RelayCache) NewWriter() (*RelayCacheWriter, error) {
+	err := os.MkdirAll(c.dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cache directory err:%s", err)
+	}
+	tmp, err := os.CreateTemp(c.dir, rELAY_CACHE_FILE+".*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create relay cache err:%s", err)
+	}
+	return &RelayCacheWriter{cache: c, tmp: tmp}, nil
+}
+
+// A failing disk must not break the download, so errors are kept for Commit.
+func (w *RelayCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.tmp.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *RelayCacheWriter) Commit(meta RelayCacheMeta) error {
+	path := filepath.Join(w.cache.dir, rELAY_CACHE_FILE)
+	err := w.tmp.Close()
+	if w.err != nil {
+		err = w.err
+	}
+	if err != nil {
+		os.Remove(w.tmp.Name())
+		return fmt.Errorf("unable to write %s err:%s", path, err)
+	}
+
+	err = os.Rename(w.tmp.Name(), path)
+	if err != nil {
+		os.Remove(w.tmp.Name())
+		return fmt.Errorf("unable to replace %s err:%s", path, err)
+	}
+	return w.cache.Store(nil, meta)
+}
+
+// Safe to call after Commit.
+func (w *RelayCacheWriter) Abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// Writes through a temporary file so an interrupted write never leaves a
+// truncated cache behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to create %s err:%s", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write %s err:%s", path, err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write %s err:%s", path, err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("unable to replace %s err:%s", path, err)
+	}
+	return nil
+}
+
+func (m *MozClient) newRelayCacheWriter() *RelayCacheWriter {
+	if m.relayCache == nil {
+		return nil
+	}
+	writer, err := m.relayCache.NewWriter()
+	if err != nil {
+		log.Printf("Unable to update relay cache err:%s\n", err)
+		return nil
+	}
+	return writer
+}
+
+func (m *MozClient) storeRelayCache(body []byte, meta RelayCacheMeta) {
+	if m.relayCache == nil {
+		return
+	}
+	err := m.relayCache.Store(body, meta)
+	if err != nil {
+		log.Printf("Unable to update relay cache err:%s\n", err)
+	}
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+	}
+}
+
+func (r *RelayList) StatusText() string {
+	if r == nil {
+		return "Server list unavailable"
+	}
+	age := formatAge(time.Since(r.FetchedAt))
+	if r.FromSnapshot {
+		return fmt.Sprintf("Offline, using bundled server list from %s, servers may be outdated", age)
+	}
+	if r.FromCache {
+		return fmt.Sprintf("Offline, using server list from %s", age)
+	}
+	return fmt.Sprintf("Server list updated %s", age)
+}
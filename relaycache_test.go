@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRelayCacheKeepsLastGoodList(t *testing.T) {
+	good := syntheticRelayList(2, 2, 2)
+	var hits atomic.Int32
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("ETag", `"good"`)
+			w.Write(good)
+			return
+		}
+		// Parses fine but has no relays left after validation.
+		w.Header().Set("ETag", `"empty"`)
+		w.Write([]byte(`{"locations":{},"wireguard":{"relays":[]}}`))
+	})
+	client.SetRelayCache(&RelayCache{dir: t.TempDir()})
+
+	relay, err := client.GetRelayList(context.Background())
+	if err != nil {
+		t.Fatalf("first GetRelayList err:%s", err)
+	}
+	if relay.FromCache || countRelays(relay) != 8 {
+		t.Fatalf("got %d relays FromCache:%t, want 8 from the server", countRelays(relay), relay.FromCache)
+	}
+
+	relay, err = client.GetRelayList(context.Background())
+	if err != nil {
+		t.Fatalf("second GetRelayList err:%s", err)
+	}
+	if !relay.FromCache || countRelays(relay) != 8 {
+		t.Errorf("got %d relays FromCache:%t, want the 8 cached ones", countRelays(relay), relay.FromCache)
+	}
+
+	meta, err := client.relayCache.LoadMeta(client.endpoints.RelayList)
+	if err != nil {
+		t.Fatalf("LoadMeta err:%s", err)
+	}
+	if meta.ETag != `"good"` {
+		t.Errorf("cache metadata was replaced, got ETag %s", meta.ETag)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Mozilla names the per-city list "servers" where Mullvad's public v1 list says
+// "relays", the entries themselves share the same field names.
+type legacyCountry struct {
+	Name   string `json:"name"`
+	Code   string `json:"code"`
+	Cities []struct {
+		Name      string  `json:"name"`
+		Code      string  `json:"code"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Relays    []Relay `json:"relays"`
+		Servers   []Relay `json:"servers"`
+	} `json:"cities"`
+}
+
+// Mullvad's app API lists relays flat and refers to a shared location table
+// by keys like "se-got".
+type appLocation struct {
+	City      string  `json:"city"`
+	Country   string  `json:"country"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type appRelay struct {
+	Relay
+	Location string `json:"location"`
+}
+
+// Groups relays by location as they are decoded. Mullvad's app API may list
+// relays before the locations they refer to, so names are filled in at the end.
+type relayListBuilder struct {
+	relay     RelayList
+	countries map[string]int
+	cities    map[string][2]int
+	locations map[string]appLocation
+}
+
+func newRelayListBuilder() *relayListBuilder {
+	return &relayListBuilder{
+		countries: make(map[string]int),
+		cities:    make(map[string][2]int),
+		locations: make(map[string]appLocation),
+	}
+}
+
+func (b *relayListBuilder) addLegacyCountry(c1 *legacyCountry) {
+	country := Country{
+		Name:   c1.Name,
+		Code:   c1.Code,
+		Cities: make([]City, 0, len(c1.Cities)),
+	}
+	for _, c2 := range c1.Cities {
+		relays := append(c2.Relays, c2.Servers...)
+		// These formats only list relays that are in service.
+		for i := range relays {
+			relays[i].Active = true
+		}
+		country.Cities = append(country.Cities, City{
+			Name:      c2.Name,
+			Code:      c2.Code,
+			Latitude:  c2.Latitude,
+			Longitude: c2.Longitude,
+			Relays:    relays,
+		})
+	}
+	b.relay.Countries = append(b.relay.Countries, country)
+}
+
+func (b *relayListBuilder) addAppRelay(r *appRelay) error {
+	countryCode, cityCode, ok := strings.Cut(r.Location, "-")
+	if !ok {
+		return fmt.Errorf("relay %s has an invalid location %s", r.Hostname, r.Location)
+	}
+
+	ci, ok := b.countries[countryCode]
+	if !ok {
+		ci = len(b.relay.Countries)
+		b.relay.Countries = append(b.relay.Countries, Country{Code: countryCode})
+		b.countries[countryCode] = ci
+	}
+
+	position, ok := b.cities[r.Location]
+	if !ok {
+		country := &b.relay.Countries[ci]
+		position = [2]int{ci, len(country.Cities)}
+		country.Cities = append(country.Cities, City{Code: cityCode})
+		b.cities[r.Location] = position
+	}
+
+	city := &b.relay.Countries[position[0]].Cities[position[1]]
+	city.Relays = append(city.Relays, r.Relay)
+	return nil
+}
+
+func (b *relayListBuilder) finish() (*RelayList, error) {
+	if len(b.cities) == 0 {
+		return &b.relay, nil
+	}
+
+	for location, position := range b.cities {
+		l, ok := b.locations[location]
+		if !ok {
+			return nil, fmt.Errorf("relays refer to an unknown location %s", location)
+		}
+		country := &b.relay.Countries[position[0]]
+		country.Name = l.Country
+		city := &country.Cities[position[1]]
+		city.Name = l.City
+		city.Latitude = l.Latitude
+		city.Longitude = l.Longitude
+	}
+
+	for i := range b.relay.Countries {
+		cities := b.relay.Countries[i].Cities
+		sort.Slice(cities, func(i, j int) bool {
+			return cities[i].Name < cities[j].Name
+		})
+	}
+	sort.Slice(b.relay.Countries, func(i, j int) bool {
+		return b.relay.Countries[i].Name < b.relay.Countries[j].Name
+	})
+	return &b.relay, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %s but got %v", want, token)
+	}
+	return nil
+}
+
+// Calls fn for every key of the object at the decoder's position, fn has to
+// consume the value.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("expected object key but got %v", token)
+		}
+		err = fn(key)
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func decodeArray(dec *json.Decoder, fn func() error) error {
+	err := expectDelim(dec, '[')
+	if err != nil {
+		return err
+	}
+	for dec.More() {
+		err = fn()
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func skipValue(dec *json.Decoder) error {
+	var skip json.RawMessage
+	return dec.Decode(&skip)
+}
+
+// Accepts Mullvad's app API, Mullvad's public v1 list and Mozilla's server
+// list. Relays are decoded one at a time so the whole document never has to be
+// held in memory.
+func decodeRelayListStream(r io.Reader) (*RelayList, error) {
+	dec := json.NewDecoder(r)
+	builder := newRelayListBuilder()
+
+	err := decodeObject(dec, func(key string) error {
+		switch key {
+		case "countries":
+			return decodeArray(dec, func() error {
+				var country legacyCountry
+				err := dec.Decode(&country)
+				if err != nil {
+					return err
+				}
+				builder.addLegacyCountry(&country)
+				return nil
+			})
+		case "locations":
+			return decodeObject(dec, func(location string) error {
+				var l appLocation
+				err := dec.Decode(&l)
+				if err != nil {
+					return err
+				}
+				builder.locations[location] = l
+				return nil
+			})
+		case "wireguard":
+			return decodeObject(dec, func(key string) error {
+				switch key {
+				case "port_ranges":
+					return dec.Decode(&builder.relay.WireGuard.PortRanges)
+				case "ipv4_gateway":
+					return dec.Decode(&builder.relay.WireGuard.IPv4Gateway)
+				case "ipv6_gateway":
+					return dec.Decode(&builder.relay.WireGuard.IPv6Gateway)
+				case "relays":
+					return decodeArray(dec, func() error {
+						var relay appRelay
+						err := dec.Decode(&relay)
+						if err != nil {
+							return err
+						}
+						return builder.addAppRelay(&relay)
+					})
+				}
+				return skipValue(dec)
+			})
+		}
+		return skipValue(dec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return builder.finish()
+}
+
+func (w WireGuardInfo) PortAllowed(port uint16) bool {
+	if len(w.PortRanges) == 0 {
+		return true
+	}
+	for _, r := range w.PortRanges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves a port the relays do not listen on into the first allowed range.
+func (w WireGuardInfo) Port(port uint16) uint16 {
+	if w.PortAllowed(port) {
+		return port
+	}
+	return w.PortRanges[0][0]
+}
+
+// The relay gateways double as DNS resolvers inside the tunnel.
+func (w WireGuardInfo) DNS() []netip.Addr {
+	dns := make([]netip.Addr, 0, 2)
+	for _, gateway := range []string{w.IPv4Gateway, w.IPv6Gateway} {
+		addr, err := netip.ParseAddr(gateway)
+		if err == nil {
+			dns = append(dns, addr)
+		}
+	}
+	if len(dns) == 0 {
+		dns = append(dns, netip.MustParseAddr(dEFAULT_DNS))
+	}
+	return dns
+}
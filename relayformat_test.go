@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Builds an app API style list of countries*cities*relays relays, roughly
+// the shape of Mullvad's real list at a few times its size.
+func syntheticRelayList(countries int, cities int, relays int) []byte {
+	locations := make(map[string]appLocation)
+	wgRelays := make([]map[string]any, 0, countries*cities*relays)
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for c1 := 0; c1 < countries; c1++ {
+		for c2 := 0; c2 < cities; c2++ {
+			location := fmt.Sprintf("c%d-t%d", c1, c2)
+			locations[location] = appLocation{
+				City:      fmt.Sprintf("City %d", c2),
+				Country:   fmt.Sprintf("Country %d", c1),
+				Latitude:  float64(c1),
+				Longitude: float64(c2),
+			}
+			for r := 0; r < relays; r++ {
+				wgRelays = append(wgRelays, map[string]any{
+					"hostname":     fmt.Sprintf("%s-wg-%03d", location, r),
+					"location":     location,
+					"active":       true,
+					"owned":        r%2 == 0,
+					"provider":     "Synthetic",
+					"weight":       100,
+					"ipv4_addr_in": fmt.Sprintf("10.%d.%d.%d", c1, c2, r),
+					"ipv6_addr_in": fmt.Sprintf("fd00::%x:%x:%x", c1, c2, r),
+					"public_key":   key,
+				})
+			}
+		}
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"locations": locations,
+		"openvpn":   map[string]any{"ports": []int{1194}, "relays": []any{}},
+		"wireguard": map[string]any{
+			"port_ranges":  [][2]uint16{{53, 53}, {4000, 33433}},
+			"ipv4_gateway": "10.64.0.1",
+			"ipv6_gateway": "fc00:bbbb:bbbb:bb01::1",
+			"relays":       wgRelays,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func countRelays(list *RelayList) int {
+	total := 0
+	for _, country := range list.Countries {
+		for _, city := range country.Cities {
+			total += len(city.Relays)
+		}
+	}
+	return total
+}
+
+func TestDecodeRelayListStreamAppFormat(t *testing.T) {
+	list, err := decodeRelayListStream(bytes.NewReader(syntheticRelayList(3, 4, 5)))
+	if err != nil {
+		t.Fatalf("decode err:%s", err)
+	}
+
+	if len(list.Countries) != 3 || len(list.Countries[0].Cities) != 4 {
+		t.Errorf("got %d countries with %d cities, want 3 with 4", len(list.Countries), len(list.Countries[0].Cities))
+	}
+	if countRelays(list) != 60 {
+		t.Errorf("got %d relays, want 60", countRelays(list))
+	}
+	if list.Countries[0].Name != "Country 0" || list.Countries[0].Cities[1].Name != "City 1" {
+		t.Errorf("locations were not resolved, got %s/%s", list.Countries[0].Name, list.Countries[0].Cities[1].Name)
+	}
+	if list.WireGuard.IPv4Gateway != "10.64.0.1" || len(list.WireGuard.PortRanges) != 2 {
+		t.Errorf("wireguard info not decoded, got %+v", list.WireGuard)
+	}
+}
+
+func TestDecodeRelayListStreamLegacyFormat(t *testing.T) {
+	body := `{"countries":[{"name":"Sweden","code":"se","cities":[
+		{"name":"Gothenburg","code":"got","latitude":57.7,"longitude":11.97,
+		 "relays":[{"hostname":"se-got-wg-001"}],"servers":[{"hostname":"se-got-wg-002"}]}]}]}`
+
+	list, err := decodeRelayListStream(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("decode err:%s", err)
+	}
+	relays := list.Countries[0].Cities[0].Relays
+	if len(relays) != 2 || !relays[0].Active || !relays[1].Active {
+		t.Errorf("got relays %+v, want two active relays", relays)
+	}
+}
+
+func TestDecodeRelayListStreamUnknownLocation(t *testing.T) {
+	body := `{"locations":{},"wireguard":{"relays":[{"hostname":"se-got-wg-001","location":"se-got"}]}}`
+	_, err := decodeRelayListStream(strings.NewReader(body))
+	if err == nil {
+		t.Fatal("expected an error for a relay in an unknown location")
+	}
+}
+
+func BenchmarkDecodeRelayListStream(b *testing.B) {
+	body := syntheticRelayList(40, 10, 10)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		list, err := decodeRelayListStream(bytes.NewReader(body))
+		if err != nil {
+			b.Fatalf("decode err:%s", err)
+		}
+		if len(list.Countries) != 40 {
+			b.Fatalf("got %d countries, want 40", len(list.Countries))
+		}
+	}
+}
+
+func BenchmarkNewRelayIndex(b *testing.B) {
+	list, err := decodeRelayListStream(bytes.NewReader(syntheticRelayList(40, 10, 10)))
+	if err != nil {
+		b.Fatalf("decode err:%s", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		index := NewRelayIndex(list)
+		if index.Len() != 4000 {
+			b.Fatalf("got %d relays, want 4000", index.Len())
+		}
+	}
+}
+
+// What loadRelays does with a downloaded list: decode, validate and index.
+func BenchmarkLoadRelayList(b *testing.B) {
+	body := syntheticRelayList(40, 10, 10)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		list, err := decodeRelayListStream(bytes.NewReader(body))
+		if err != nil {
+			b.Fatalf("decode err:%s", err)
+		}
+		list, report := ValidateRelayList(list)
+		if report.Kept != 4000 {
+			b.Fatalf("kept %d relays, want 4000", report.Kept)
+		}
+		index := NewRelayIndex(list)
+		if index.Len() != 4000 {
+			b.Fatalf("got %d relays, want 4000", index.Len())
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Built once per relay list so lookups by hostname, code or display name do
+// not have to walk every country and city. It holds pointers into the list,
+// so it is built from the validated copy rather than while decoding, when
+// the relay slices still grow and may hold relays validation drops.
+type RelayIndex struct {
+	list      *RelayList
+	flat      []FlatRelay
+	byHost    map[string]int
+	byCountry map[string][]int
+	byCity    map[string][]int
+
+	countryByName map[string]*Country
+	cityByName    map[string]*City
+}
+
+func cityKey(country string, city string) string {
+	return strings.ToLower(country) + "/" + strings.ToLower(city)
+}
+
+func NewRelayIndex(list *RelayList) *RelayIndex {
+	index := &RelayIndex{
+		list:          list,
+		flat:          make([]FlatRelay, 0),
+		byHost:        make(map[string]int),
+		byCountry:     make(map[string][]int),
+		byCity:        make(map[string][]int),
+		countryByName: make(map[string]*Country),
+		cityByName:    make(map[string]*City),
+	}
+
+	for i := range list.GetCountries() {
+		index.addCountry(&list.Countries[i])
+	}
+	return index
+}
+
+func (x *RelayIndex) addCountry(c1 *Country) {
+	x.countryByName[c1.Name] = c1
+	for j := range c1.Cities {
+		c2 := &c1.Cities[j]
+		x.cityByName[c1.Name+"/"+c2.Name] = c2
+		for k := range c2.Relays {
+			r := &c2.Relays[k]
+			if _, ok := x.byHost[r.Hostname]; ok {
+				continue
+			}
+
+			i := len(x.flat)
+			x.flat = append(x.flat, FlatRelay{
+				CountryName: c1.Name,
+				CountryCode: c1.Code,
+
+				CityName:      c2.Name,
+				CityCode:      c2.Code,
+				CityLatitude:  c2.Latitude,
+				CityLongitude: c2.Longitude,
+
+				RelayHostname:     r.Hostname,
+				RelayIpV4AddrIn:   r.IpV4AddrIn,
+				RelayIpV6AddrIn:   r.IpV6AddrIn,
+				RelayPubKey:       r.PubKey,
+				RelayMultihopPort: r.MultihopPort,
+
+				Relay: r,
+			})
+			x.byHost[r.Hostname] = i
+			countryCode := strings.ToLower(c1.Code)
+			x.byCountry[countryCode] = append(x.byCountry[countryCode], i)
+			cityCode := cityKey(c1.Code, c2.Code)
+			x.byCity[cityCode] = append(x.byCity[cityCode], i)
+		}
+	}
+}
+
+func (x *RelayIndex) List() *RelayList {
+	if x == nil {
+		return nil
+	}
+	return x.list
+}
+
+func (x *RelayIndex) Len() int {
+	if x == nil {
+		return 0
+	}
+	return len(x.flat)
+}
+
+func (x *RelayIndex) All() []FlatRelay {
+	if x == nil {
+		return nil
+	}
+	return x.flat
+}
+
+func (x *RelayIndex) Each(fn func(r *FlatRelay) bool) {
+	if x == nil {
+		return
+	}
+	for i := range x.flat {
+		if !fn(&x.flat[i]) {
+			return
+		}
+	}
+}
+
+func (x *RelayIndex) Relay(hostname string) *FlatRelay {
+	if x == nil {
+		return nil
+	}
+	i, ok := x.byHost[hostname]
+	if !ok {
+		return nil
+	}
+	return &x.flat[i]
+}
+
+func (x *RelayIndex) collect(indices []int) []*FlatRelay {
+	result := make([]*FlatRelay, 0, len(indices))
+	for _, i := range indices {
+		result = append(result, &x.flat[i])
+	}
+	return result
+}
+
+func (x *RelayIndex) ByCountry(countryCode string) []*FlatRelay {
+	if x == nil {
+		return nil
+	}
+	return x.collect(x.byCountry[strings.ToLower(countryCode)])
+}
+
+func (x *RelayIndex) ByCity(countryCode string, cityCode string) []*FlatRelay {
+	if x == nil {
+		return nil
+	}
+	return x.collect(x.byCity[cityKey(countryCode, cityCode)])
+}
+
+// Lookups by display name, as used by the server picker.
+func (x *RelayIndex) Country(name string) *Country {
+	if x == nil {
+		return nil
+	}
+	return x.countryByName[name]
+}
+
+func (x *RelayIndex) City(countryName string, cityName string) *City {
+	if x == nil {
+		return nil
+	}
+	return x.cityByName[countryName+"/"+cityName]
+}
+
+func (x *RelayIndex) Find(countryName string, cityName string, hostname string) *Relay {
+	r := x.Relay(hostname)
+	if r == nil || r.CountryName != countryName || r.CityName != cityName {
+		return nil
+	}
+	return r.Relay
+}
+
+// Lower is better: prefix, then substring, then the query's characters
+// appearing in order.
+func matchScore(value string, query string) (int, bool) {
+	value = strings.ToLower(value)
+	if strings.HasPrefix(value, query) {
+		return 0, true
+	}
+	if strings.Contains(value, query) {
+		return 1, true
+	}
+
+	qi := 0
+	for i := 0; i < len(value) && qi < len(query); i++ {
+		if value[i] == query[qi] {
+			qi++
+		}
+	}
+	if qi == len(query) {
+		return 2 + len(value) - len(query), true
+	}
+	return 0, false
+}
+
+func (x *RelayIndex) Search(query string, limit int) []*FlatRelay {
+	if x == nil {
+		return nil
+	}
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	type match struct {
+		score int
+		relay *FlatRelay
+	}
+	matches := make([]match, 0)
+	for i := range x.flat {
+		r := &x.flat[i]
+		best := -1
+		for _, field := range []string{r.RelayHostname, r.CityName, r.CountryName, r.CountryCode, r.CityCode} {
+			score, ok := matchScore(field, query)
+			if ok && (best < 0 || score < best) {
+				best = score
+			}
+		}
+		if best >= 0 {
+			matches = append(matches, match{score: best, relay: r})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+		return matches[i].relay.RelayHostname < matches[j].relay.RelayHostname
+	})
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	result := make([]*FlatRelay, 0, len(matches))
+	for _, m := range matches {
+		result = append(result, m.relay)
+	}
+	return result
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+var aNY_CITY = "Any city"
+var aNY_RELAY = "Any relay"
+
+// How many relays Connect tries before giving up on an "any" selection.
+var rELAY_PICK_ATTEMPTS = 3
+
+// Empty City or Relay fields mean the app picks one itself.
+func (s SelectState) IsAny() bool {
+	return s.Relay == ""
+}
+
+func (s SelectState) String() string {
+	switch {
+	case s.Relay != "":
+		return s.Relay
+	case s.City != "":
+		return fmt.Sprintf("%s, %s", s.City, s.Country)
+	}
+	return s.Country
+}
+
+// The picker callbacks may fire from relay loads in the background, so the
+// selection is only touched under selectMu.
+func (m *MozApp) selection() SelectState {
+	m.selectMu.Lock()
+	defer m.selectMu.Unlock()
+	return m.selectState
+}
+
+func (m *MozApp) setSelection(fn func(s *SelectState)) {
+	m.selectMu.Lock()
+	defer m.selectMu.Unlock()
+	fn(&m.selectState)
+}
+
+// Relays in a country, or in one of its cities when cityName is set, by
+// display name.
+func (x *RelayIndex) Candidates(countryName string, cityName string) []*Relay {
+	relays := make([]*Relay, 0)
+	x.Each(func(r *FlatRelay) bool {
+		if r.CountryName == countryName && (cityName == "" || r.CityName == cityName) {
+			relays = append(relays, r.Relay)
+		}
+		return true
+	})
+	return relays
+}
+
+// Picks an active relay with a chance proportional to its weight, relays in
+// skip are left out. Lists without weights are picked from evenly.
+func PickRelay(relays []*Relay, skip map[string]bool, random func() float64) *Relay {
+	if random == nil {
+		random = rand.Float64
+	}
+
+	candidates := make([]*Relay, 0, len(relays))
+	total := 0
+	for _, r := range relays {
+		if !r.Active || skip[r.Hostname] {
+			continue
+		}
+		candidates = append(candidates, r)
+		if r.Weight > 0 {
+			total += r.Weight
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if total == 0 {
+		i := int(random() * float64(len(candidates)))
+		return candidates[min(i, len(candidates)-1)]
+	}
+
+	target := int(random() * float64(total))
+	var last *Relay
+	for _, r := range candidates {
+		if r.Weight <= 0 {
+			continue
+		}
+		if target < r.Weight {
+			return r
+		}
+		target -= r.Weight
+		last = r
+	}
+	return last
+}
+
+func (m *MozApp) selectedRelay(skip map[string]bool) (*Relay, error) {
+	index := m.relays().index
+	if index == nil {
+		return nil, fmt.Errorf("relay list is not available")
+	}
+
+	state := m.selection()
+	if !state.IsAny() {
+		relay := index.Find(state.Country, state.City, state.Relay)
+		if relay == nil {
+			return nil, fmt.Errorf("relay %s is not in the relay list", state.Relay)
+		}
+		return relay, nil
+	}
+
+	if state.Country == "" {
+		return nil, fmt.Errorf("please select a country first")
+	}
+	relay := PickRelay(index.Candidates(state.Country, state.City), skip, nil)
+	if relay == nil {
+		return nil, fmt.Errorf("no active relays left in %s", state)
+	}
+	log.Printf("Picked relay %s for %s\n", relay.Hostname, state)
+	return relay, nil
+}
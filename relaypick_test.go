@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestPickRelay(t *testing.T) {
+	relays := func(weights ...int) []*Relay {
+		list := make([]*Relay, 0, len(weights))
+		for i, w := range weights {
+			list = append(list, &Relay{Hostname: string(rune('a' + i)), Active: true, Weight: w})
+		}
+		return list
+	}
+	inactive := relays(100, 100, 100)
+	inactive[0].Active = false
+
+	for _, tc := range []struct {
+		name   string
+		relays []*Relay
+		skip   map[string]bool
+		random float64
+		want   string
+	}{
+		{"weighted low", relays(100, 300), nil, 0.2, "a"},
+		{"weighted high", relays(100, 300), nil, 0.3, "b"},
+		{"weighted top", relays(100, 300), nil, 0.999, "b"},
+		{"zero weight never picked", relays(0, 100), nil, 0, "b"},
+		{"inactive skipped", inactive, nil, 0, "b"},
+		{"skip list", relays(100, 100, 100), map[string]bool{"a": true, "b": true}, 0, "c"},
+		{"all zero weights uniform low", relays(0, 0, 0, 0), nil, 0.1, "a"},
+		{"all zero weights uniform high", relays(0, 0, 0, 0), nil, 0.8, "d"},
+		{"nothing left", relays(100), map[string]bool{"a": true}, 0, ""},
+	} {
+		relay := PickRelay(tc.relays, tc.skip, func() float64 { return tc.random })
+		got := ""
+		if relay != nil {
+			got = relay.Hostname
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
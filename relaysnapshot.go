@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//go:generate go run ./tools/relaysnapshot -o relays_snapshot.json
+
+//go:embed relays_snapshot.json
+var relaySnapshotJson []byte
+
+type relaySnapshot struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Url       string          `json:"url"`
+	Relays    json.RawMessage `json:"relays"`
+}
+
+// The bundled list is only used when neither the network nor the cache can
+// provide one, e.g. on a first run while offline.
+func loadRelaySnapshot() (*RelayList, error) {
+	var snapshot relaySnapshot
+	err := json.Unmarshal(relaySnapshotJson, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse bundled relay list err:%s", err)
+	}
+	relay, err := decodeRelayListStream(bytes.NewReader(snapshot.Relays))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse bundled relay list err:%s", err)
+	}
+	if len(relay.Countries) == 0 {
+		return nil, fmt.Errorf("bundled relay list is empty")
+	}
+
+	relay.FetchedAt = snapshot.FetchedAt
+	relay.FromCache = true
+	relay.FromSnapshot = true
+	return relay, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// An empty snapshot means an offline first run shows no servers, so this
+// fails until go generate has been run with network access.
+func TestRelaySnapshot(t *testing.T) {
+	var snapshot relaySnapshot
+	err := json.Unmarshal(relaySnapshotJson, &snapshot)
+	if err != nil {
+		t.Fatalf("bundled relay list is not valid JSON err:%s", err)
+	}
+
+	relay, err := loadRelaySnapshot()
+	if err != nil {
+		t.Fatalf("bundled relay list unusable, run go generate err:%s", err)
+	}
+
+	if !relay.FromSnapshot || relay.FetchedAt.IsZero() {
+		t.Errorf("snapshot metadata missing, got FromSnapshot:%t FetchedAt:%s", relay.FromSnapshot, relay.FetchedAt)
+	}
+	_, report := ValidateRelayList(relay)
+	if report.Kept == 0 {
+		t.Errorf("bundled relay list has no usable relays, %s", report)
+	}
+}
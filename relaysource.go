@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+type RelaySource interface {
+	Name() string
+	GetRelayList(ctx context.Context) (*RelayList, error)
+}
+
+var rELAY_SOURCE_MULLVAD = "Mullvad"
+var rELAY_SOURCE_MOZILLA = "Mozilla"
+var rELAY_SOURCE_FILE = "File"
+
+var RelaySourceNames = []string{rELAY_SOURCE_MULLVAD, rELAY_SOURCE_MOZILLA, rELAY_SOURCE_FILE}
+
+// Mullvad's public list, backed by the on-disk cache and bundled snapshot.
+type MullvadRelaySource struct {
+	Client *MozClient
+}
+
+func (s *MullvadRelaySource) Name() string {
+	return rELAY_SOURCE_MULLVAD
+}
+
+func (s *MullvadRelaySource) GetRelayList(ctx context.Context) (*RelayList, error) {
+	return s.Client.GetRelayList(ctx)
+}
+
+// The list the official Mozilla VPN client uses. It needs a valid token.
+type MozillaRelaySource struct {
+	Client *MozClient
+	Token  func() string
+}
+
+func (s *MozillaRelaySource) Name() string {
+	return rELAY_SOURCE_MOZILLA
+}
+
+func (s *MozillaRelaySource) GetRelayList(ctx context.Context) (*RelayList, error) {
+	mozToken := s.Token()
+	if mozToken == "" {
+		return nil, fmt.Errorf("the Mozilla server list needs a logged in account")
+	}
+	return s.Client.GetServerList(ctx, mozToken)
+}
+
+type FileRelaySource struct {
+	Path string
+}
+
+func (s *FileRelaySource) Name() string {
+	return rELAY_SOURCE_FILE
+}
+
+func (s *FileRelaySource) GetRelayList(ctx context.Context) (*RelayList, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read relay list %s err:%s", s.Path, err)
+	}
+	defer file.Close()
+
+	relay, err := decodeRelayListStream(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse relay list %s err:%s", s.Path, err)
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		relay.FetchedAt = info.ModTime()
+	}
+	return relay, nil
+}
+
+func (m *MozClient) GetServerList(ctx context.Context, mozToken string) (*RelayList, error) {
+	ctx, cancel := withDefaultTimeout(ctx, rELAY_LIST_TIMEOUT)
+	defer cancel()
+
+	requestUrl := m.apiUrl(v1_API, "vpn/servers")
+	req, err := http.NewRequestWithContext(ctx, "GET", requestUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable create GET request err:%s", err)
+	}
+
+	bearerAuth := fmt.Sprintf("Bearer %s", mozToken)
+	req.Header.Set("Authorization", bearerAuth)
+	req.Header.Set("User-Agent", "Fyne Moz VPN")
+
+	res, err := m.do(req, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable perform GET request err:%s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, newAPIError(req, res)
+	}
+
+	relay, err := decodeRelayListStream(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JSON as server list err:%s", err)
+	}
+	relay.FetchedAt = time.Now()
+	return relay, nil
+}
+
+func (m *MozApp) newRelaySource(name string) RelaySource {
+	switch name {
+	case rELAY_SOURCE_MOZILLA:
+		return &MozillaRelaySource{Client: m.Client, Token: m.Token}
+	case rELAY_SOURCE_FILE:
+		path := m.App.Preferences().String("RELAY_FILE")
+		if path != "" {
+			return &FileRelaySource{Path: path}
+		}
+		log.Println("No relay file configured, using the Mullvad list")
+	}
+	return &MullvadRelaySource{Client: m.Client}
+}
+
+// Everything one relay list load produced. It is published as a whole so
+// readers never see the list of one load with the index of another.
+type loadedRelays struct {
+	list     *RelayList
+	index    *RelayIndex
+	report   *RelayValidationReport
+	source   RelaySource
+	fallback error
+}
+
+var errRelayLoadSuperseded = errors.New("relay list load was superseded")
+
+// Never nil, the fields are nil until the first load succeeds.
+func (m *MozApp) relays() *loadedRelays {
+	loaded := m.relayState.Load()
+	if loaded == nil {
+		return &loadedRelays{}
+	}
+	return loaded
+}
+
+// Starting a load cancels the one in flight, so switching sources quickly
+// cannot end with an older source winning.
+func (m *MozApp) LoadRelayList() error {
+	m.relayLoadMu.Lock()
+	if m.relayLoadCancel != nil {
+		m.relayLoadCancel()
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	m.relayLoadGen++
+	gen := m.relayLoadGen
+	m.relayLoadCancel = cancel
+	m.relayLoadMu.Unlock()
+
+	loaded, err := m.loadRelays(ctx)
+
+	m.relayLoadMu.Lock()
+	defer m.relayLoadMu.Unlock()
+	if gen != m.relayLoadGen {
+		return errRelayLoadSuperseded
+	}
+	if err != nil {
+		return err
+	}
+	m.relayState.Store(loaded)
+	return nil
+}
+
+// Loads from the selected source and falls back to Mullvad, which has the
+// cache and bundled snapshot behind it. A fallback is kept so the UI can say
+// why another source is in use.
+func (m *MozApp) loadRelays(ctx context.Context) (*loadedRelays, error) {
+	source := m.newRelaySource(m.App.Preferences().StringWithFallback("RELAY_SOURCE", rELAY_SOURCE_MULLVAD))
+
+	var fallback error
+	relayList, err := source.GetRelayList(ctx)
+	if err != nil && source.Name() != rELAY_SOURCE_MULLVAD && ctx.Err() == nil {
+		log.Printf("Unable to get relay list from %s, using Mullvad err:%s\n", source.Name(), err)
+		fallback = fmt.Errorf("%s unavailable, using Mullvad", source.Name())
+		source = &MullvadRelaySource{Client: m.Client}
+		relayList, err = source.GetRelayList(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get relay list err:%w", err)
+	}
+
+	relayList, report := ValidateRelayList(relayList)
+	if len(report.Issues) > 0 {
+		log.Printf("Relay list from %s has problems, %s\n", source.Name(), report)
+	}
+	if report.Kept == 0 {
+		return nil, fmt.Errorf("relay list from %s has no usable relays", source.Name())
+	}
+
+	log.Println(relayList.StatusText())
+	return &loadedRelays{
+		list:     relayList,
+		index:    NewRelayIndex(relayList),
+		report:   report,
+		source:   source,
+		fallback: fallback,
+	}, nil
+}
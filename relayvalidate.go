@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+type RelayIssue struct {
+	Hostname string
+	Country  string
+	City     string
+	Problem  string
+	Dropped  bool
+}
+
+type RelayValidationReport struct {
+	Total   int
+	Kept    int
+	Dropped int
+	Issues  []RelayIssue
+}
+
+func (r *RelayValidationReport) add(country *Country, city *City, hostname string, dropped bool, format string, args ...any) {
+	r.Issues = append(r.Issues, RelayIssue{
+		Hostname: hostname,
+		Country:  country.Name,
+		City:     city.Name,
+		Problem:  fmt.Sprintf(format, args...),
+		Dropped:  dropped,
+	})
+	if dropped {
+		r.Dropped++
+	}
+}
+
+func (r *RelayValidationReport) String() string {
+	if len(r.Issues) == 0 {
+		return fmt.Sprintf("all %d relays are valid", r.Total)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "kept %d of %d relays, dropped %d", r.Kept, r.Total, r.Dropped)
+	for _, issue := range r.Issues {
+		action := "flagged"
+		if issue.Dropped {
+			action = "dropped"
+		}
+		fmt.Fprintf(&b, "\n  %s %s (%s/%s): %s", action, issue.Hostname, issue.Country, issue.City, issue.Problem)
+	}
+	return b.String()
+}
+
+func validWgKey(key string) bool {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(keyBytes) == 32
+}
+
+func validAddr(address string, want6 bool) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	if want6 {
+		return addr.Is6() && !addr.Is4In6()
+	}
+	return addr.Is4()
+}
+
+// Returns a copy of the list with relays that would crash the picker or
+// produce a broken tunnel removed. Addresses that are merely unusable are
+// cleared as long as the relay can still be reached some other way.
+func ValidateRelayList(list *RelayList) (*RelayList, *RelayValidationReport) {
+	report := &RelayValidationReport{}
+	if list == nil {
+		return nil, report
+	}
+
+	result := *list
+	result.Countries = make([]Country, 0, len(list.Countries))
+	seen := make(map[string]bool)
+
+	for _, c1 := range list.Countries {
+		country := c1
+		if country.Name == "" {
+			country.Name = country.Code
+		}
+		country.Cities = make([]City, 0, len(c1.Cities))
+
+		for _, c2 := range c1.Cities {
+			city := c2
+			if city.Name == "" {
+				city.Name = city.Code
+			}
+			city.Relays = make([]Relay, 0, len(c2.Relays))
+
+			for _, r := range c2.Relays {
+				report.Total++
+				relay := r
+				relay.Hostname = strings.TrimSpace(relay.Hostname)
+
+				if relay.Hostname == "" {
+					report.add(&country, &city, "(no hostname)", true, "missing hostname")
+					continue
+				}
+				if seen[relay.Hostname] {
+					report.add(&country, &city, relay.Hostname, true, "duplicate hostname")
+					continue
+				}
+				if !validWgKey(relay.PubKey) {
+					report.add(&country, &city, relay.Hostname, true, "public key %q is not a 32 byte base64 key", relay.PubKey)
+					continue
+				}
+
+				if relay.IpV4AddrIn != "" && !validAddr(relay.IpV4AddrIn, false) {
+					report.add(&country, &city, relay.Hostname, false, "invalid IPv4 address %q", relay.IpV4AddrIn)
+					relay.IpV4AddrIn = ""
+				}
+				if relay.IpV6AddrIn != "" && !validAddr(relay.IpV6AddrIn, true) {
+					report.add(&country, &city, relay.Hostname, false, "invalid IPv6 address %q", relay.IpV6AddrIn)
+					relay.IpV6AddrIn = ""
+				}
+				if relay.IpV4AddrIn == "" && relay.IpV6AddrIn == "" {
+					report.add(&country, &city, relay.Hostname, true, "no usable address")
+					continue
+				}
+
+				seen[relay.Hostname] = true
+				city.Relays = append(city.Relays, relay)
+				report.Kept++
+			}
+
+			if len(city.Relays) > 0 {
+				country.Cities = append(country.Cities, city)
+			}
+		}
+
+		if len(country.Cities) > 0 {
+			result.Countries = append(result.Countries, country)
+		}
+	}
+
+	return &result, report
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Fraction of each delay that is randomised, between 0 and 1.
+	Jitter float64
+
+	random func() float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Jitter:      0.5,
+}
+
+var NoRetryPolicy = RetryPolicy{
+	MaxAttempts: 1,
+}
+
+func (m *MozClient) SetRetryPolicy(policy RetryPolicy) {
+	m.retry = policy
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	random := p.random
+	if random == nil {
+		random = rand.Float64
+	}
+	jitter := time.Duration(float64(delay) * p.Jitter * random())
+	return delay - jitter
+}
+
+// Retry-After is either a number of seconds or an HTTP date.
+func retryAfter(res *http.Response, now time.Time) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	delay := date.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+func isRetryableStatus(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// Both mean the request was turned away before being processed.
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// A request that failed to dial never reached the server, so even a POST is
+// safe to send again. Timeouts and resets are only retried for idempotent
+// requests, anything else such as a bad certificate will not fix itself.
+func isRetryableError(err error, idempotent bool) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Non-idempotent requests such as registering a device are only retried when
+// the server certainly did not act on them.
+func (m *MozClient) do(req *http.Request, idempotent bool) (*http.Response, error) {
+	ctx := req.Context()
+	policy := m.retry
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		res, err := m.client.Do(attemptReq)
+		lastAttempt := attempt+1 >= policy.MaxAttempts
+
+		var delay time.Duration
+		if err != nil {
+			if lastAttempt || ctx.Err() != nil || !isRetryableError(err, idempotent) {
+				return nil, err
+			}
+			delay = policy.backoff(attempt)
+			log.Printf("Retrying %s %s in %s err:%s\n", req.Method, req.URL.Path, delay, err)
+		} else {
+			if lastAttempt || !isRetryableStatus(res.StatusCode, idempotent) {
+				return res, nil
+			}
+
+			delay = policy.backoff(attempt)
+			if after, ok := retryAfter(res, time.Now()); ok {
+				if policy.MaxDelay > 0 && after > policy.MaxDelay {
+					return res, nil
+				}
+				delay = after
+			}
+			log.Printf("Retrying %s %s in %s status:%d\n", req.Method, req.URL.Path, delay, res.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+			res.Body.Close()
+		}
+
+		err = sleepContext(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
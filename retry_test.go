@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*MozClient, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := NewMozClient(nil, Endpoints{BaseUrl: server.URL, RelayList: server.URL})
+	client.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		random:      func() float64 { return 0 },
+	})
+	return client, server
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	client, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", server.URL, nil)
+	start := time.Now()
+	res, err := client.do(req, true)
+	if err != nil {
+		t.Fatalf("do err:%s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", res.StatusCode)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("got %d requests, want 2", hits.Load())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least the 1s from Retry-After", elapsed)
+	}
+}
+
+func TestRetryAfterBeyondMaxDelayIsNotWaited(t *testing.T) {
+	var hits atomic.Int32
+	client, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", server.URL, nil)
+	res, err := client.do(req, true)
+	if err != nil {
+		t.Fatalf("do err:%s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable || hits.Load() != 1 {
+		t.Errorf("got status %d after %d requests, want 503 after 1", res.StatusCode, hits.Load())
+	}
+}
+
+func TestRetryServerErrorOnlyWhenIdempotent(t *testing.T) {
+	for _, tc := range []struct {
+		method     string
+		idempotent bool
+		want       int32
+	}{
+		{"GET", true, 3},
+		{"POST", false, 1},
+	} {
+		var hits atomic.Int32
+		client, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+
+		req, _ := http.NewRequestWithContext(context.Background(), tc.method, server.URL, strings.NewReader("{}"))
+		res, err := client.do(req, tc.idempotent)
+		if err != nil {
+			t.Fatalf("%s do err:%s", tc.method, err)
+		}
+		res.Body.Close()
+
+		if hits.Load() != tc.want {
+			t.Errorf("%s got %d requests, want %d", tc.method, hits.Load(), tc.want)
+		}
+	}
+}
+
+func TestRetryDoesNotRetryCertificateErrors(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	// The default client does not trust the test server's certificate.
+	client := NewMozClient(&http.Client{}, Endpoints{BaseUrl: server.URL})
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, random: func() float64 { return 0 }})
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", server.URL, nil)
+	_, err := client.do(req, true)
+	if err == nil {
+		t.Fatal("expected a certificate error")
+	}
+	if connections.Load() != 1 {
+		t.Errorf("got %d connections, want 1", connections.Load())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var tOKEN_ENV = "MOZ_VPN_TOKEN"
+var tOKEN_FILE_ENV = "MOZ_VPN_TOKEN_FILE"
+var pRIVATE_KEY_ENV = "MOZ_VPN_PRIVATE_KEY"
+var pRIVATE_KEY_FILE_ENV = "MOZ_VPN_PRIVATE_KEY_FILE"
+
+func readSecretEnv(valueEnv string, fileEnv string) (string, string, error) {
+	if value := strings.TrimSpace(os.Getenv(valueEnv)); value != "" {
+		return value, valueEnv, nil
+	}
+
+	secretFile := os.Getenv(fileEnv)
+	if secretFile == "" {
+		return "", "", nil
+	}
+
+	secretBytes, err := os.ReadFile(secretFile)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read %s err:%s", secretFile, err)
+	}
+
+	value := strings.TrimSpace(string(secretBytes))
+	if value == "" {
+		return "", "", fmt.Errorf("%s is empty", secretFile)
+	}
+	return value, secretFile, nil
+}
+
+// Lets CI runners and provisioning scripts supply the token without any login
+// flow. The returned source is only used for messages.
+func externalToken() (string, string, error) {
+	return readSecretEnv(tOKEN_ENV, tOKEN_FILE_ENV)
+}
+
+// The device key that goes with an external token. It is required, the same
+// key is registered once and reused on later runs.
+func externalKeys() (string, string, error) {
+	privKey, source, err := readSecretEnv(pRIVATE_KEY_ENV, pRIVATE_KEY_FILE_ENV)
+	if err != nil || privKey == "" {
+		return "", "", err
+	}
+
+	pubKey, err := wgPublicKey(privKey)
+	if err != nil {
+		return "", "", fmt.Errorf("private key from %s is not a WireGuard key err:%s", source, err)
+	}
+	return privKey, pubKey, nil
+}
+
+func (m *MozApp) Token() string {
+	if m.externalToken != "" {
+		return m.externalToken
+	}
+	return m.App.Preferences().String("MOZ_TOKEN")
+}
+
+// An external token keeps the whole session, keys included, out of the
+// preference store.
+func (m *MozApp) GetKeys() (string, string) {
+	if m.externalToken != "" {
+		return m.externalPrivKey, m.externalPubKey
+	}
+	return m.App.Preferences().String("PRIV_KEY"), m.App.Preferences().String("PUB_KEY")
+}
+
+// A key supplied with an external token is registered as is.
+func (m *MozApp) newDeviceKeys() (string, string, error) {
+	if m.externalToken != "" {
+		return m.externalPrivKey, m.externalPubKey, nil
+	}
+
+	privKey, pubKey, err := GenerateWgKeys()
+	if err != nil {
+		return "", "", fmt.Errorf("error generating key err:%s", err)
+	}
+	return privKey, pubKey, nil
+}
+
+func (m *MozApp) setKeys(privKey string, pubKey string) {
+	if m.externalToken != "" {
+		m.externalPrivKey = privKey
+		m.externalPubKey = pubKey
+		return
+	}
+	m.App.Preferences().SetString("PRIV_KEY", privKey)
+	m.App.Preferences().SetString("PUB_KEY", pubKey)
+}
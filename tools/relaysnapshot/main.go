@@ -0,0 +1,83 @@
+// Command relaysnapshot downloads the current relay list and writes it in the
+// format embedded by the app as its last-resort fallback. Run it through
+// `go generate` before cutting a release.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+type snapshot struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Url       string          `json:"url"`
+	Relays    json.RawMessage `json:"relays"`
+}
+
+func main() {
+	url := flag.String("url", "https://api.mullvad.net/app/v1/relays", "relay list to snapshot")
+	out := flag.String("o", "relays_snapshot.json", "output file")
+	flag.Parse()
+
+	client := &http.Client{Timeout: time.Minute}
+	res, err := client.Get(*url)
+	if err != nil {
+		log.Fatalf("Unable to download relay list err:%s\n", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		log.Fatalf("Unable to download relay list status:%d\n", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Fatalf("Unable to read relay list err:%s\n", err)
+	}
+
+	// Either the app API with a flat WireGuard relay list or the older list
+	// grouped by country.
+	var relays struct {
+		Countries []json.RawMessage `json:"countries"`
+		WireGuard struct {
+			Relays []json.RawMessage `json:"relays"`
+		} `json:"wireguard"`
+	}
+	err = json.Unmarshal(body, &relays)
+	if err != nil {
+		log.Fatalf("Unable to parse relay list err:%s\n", err)
+	}
+	count := len(relays.Countries) + len(relays.WireGuard.Relays)
+	if count == 0 {
+		log.Fatalf("Relay list from %s has no relays\n", *url)
+	}
+
+	var compact bytes.Buffer
+	err = json.Compact(&compact, body)
+	if err != nil {
+		log.Fatalf("Unable to compact relay list err:%s\n", err)
+	}
+
+	// MarshalIndent would indent the embedded list again, keep it compact.
+	data, err := json.Marshal(snapshot{
+		FetchedAt: time.Now().UTC().Truncate(time.Second),
+		Url:       *url,
+		Relays:    compact.Bytes(),
+	})
+	if err != nil {
+		log.Fatalf("Unable to marshal snapshot err:%s\n", err)
+	}
+
+	err = os.WriteFile(*out, append(data, '\n'), 0o644)
+	if err != nil {
+		log.Fatalf("Unable to write %s err:%s\n", *out, err)
+	}
+	fmt.Printf("Wrote %d entries to %s\n", count, *out)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+var tUNNEL_NAME = "wg-moz"
+var wIREGUARD_PORT = 51820
+var tUNNEL_MTU = 1420
+var tUNNEL_FWMARK = 51820
+var dEFAULT_DNS = "10.64.0.1"
+var pERSISTENT_KEEPALIVE = 25
+var hANDSHAKE_TIMEOUT = 5 * time.Second
+
+type TunnelConfig struct {
+	PrivateKey    string
+	Addresses     []netip.Prefix
+	PeerPubKey    string
+	PeerEndpoint  netip.AddrPort
+	AllowedPrefix []netip.Prefix
+	DNS           []netip.Addr
+}
+
+type Tunnel struct {
+	Name   string
+	config TunnelConfig
+	device *device.Device
+	// Commands that undo the host configuration, in the order it was applied.
+	undo [][]string
+}
+
+func relayEndpoint(r *Relay, wg WireGuardInfo, preferIPv6 bool) (netip.AddrPort, error) {
+	address := r.IpV4AddrIn
+	if (preferIPv6 && r.IpV6AddrIn != "") || address == "" {
+		address = r.IpV6AddrIn
+	}
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("unable to parse relay address %s err:%s", address, err)
+	}
+	return netip.AddrPortFrom(addr, wg.Port(uint16(wIREGUARD_PORT))), nil
+}
+
+// wg carries the DNS resolvers and ports of the relay list r came from.
+func NewTunnelConfig(privKey string, d *Device, r *Relay, wg WireGuardInfo, preferIPv6 bool) (*TunnelConfig, error) {
+	addresses := make([]netip.Prefix, 0, 2)
+	for _, a := range []string{d.IPv4Address, d.IPv6Address} {
+		if a == "" {
+			continue
+		}
+		prefix, err := parseDeviceAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse device address %s err:%s", a, err)
+		}
+		addresses = append(addresses, prefix)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("device %s has no tunnel address", d.Name)
+	}
+
+	endpoint, err := relayEndpoint(r, wg, preferIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TunnelConfig{
+		PrivateKey:   privKey,
+		Addresses:    addresses,
+		PeerPubKey:   r.PubKey,
+		PeerEndpoint: endpoint,
+		AllowedPrefix: []netip.Prefix{
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::/0"),
+		},
+		DNS: wg.DNS(),
+	}, nil
+}
+
+func parseDeviceAddress(address string) (netip.Prefix, error) {
+	if strings.Contains(address, "/") {
+		return netip.ParsePrefix(address)
+	}
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func keyToHex(key string) (string, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode key err:%s", err)
+	}
+	if len(keyBytes) != 32 {
+		return "", fmt.Errorf("key is %d bytes but WireGuard keys are 32 bytes", len(keyBytes))
+	}
+	return hex.EncodeToString(keyBytes), nil
+}
+
+func (c *TunnelConfig) uapiConfig() (string, error) {
+	privKey, err := keyToHex(c.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key err:%s", err)
+	}
+	peerKey, err := keyToHex(c.PeerPubKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid relay public key err:%s", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", privKey)
+	fmt.Fprintf(&b, "fwmark=%d\n", tUNNEL_FWMARK)
+	b.WriteString("replace_peers=true\n")
+	fmt.Fprintf(&b, "public_key=%s\n", peerKey)
+	fmt.Fprintf(&b, "endpoint=%s\n", c.PeerEndpoint)
+	// Also makes the device send a handshake as soon as it is up.
+	fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", pERSISTENT_KEEPALIVE)
+	b.WriteString("replace_allowed_ips=true\n")
+	for _, p := range c.AllowedPrefix {
+		fmt.Fprintf(&b, "allowed_ip=%s\n", p)
+	}
+	return b.String(), nil
+}
+
+func StartTunnel(config TunnelConfig) (*Tunnel, error) {
+	uapi, err := config.uapiConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tunDevice, err := tun.CreateTUN(tUNNEL_NAME, tUNNEL_MTU)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create TUN device err:%s", err)
+	}
+
+	name, err := tunDevice.Name()
+	if err != nil {
+		tunDevice.Close()
+		return nil, fmt.Errorf("unable to get TUN device name err:%s", err)
+	}
+
+	logger := device.NewLogger(device.LogLevelError, fmt.Sprintf("(%s) ", name))
+	wgDevice := device.NewDevice(tunDevice, conn.NewDefaultBind(), logger)
+
+	err = wgDevice.IpcSet(uapi)
+	if err != nil {
+		wgDevice.Close()
+		return nil, fmt.Errorf("unable to configure WireGuard device err:%s", err)
+	}
+
+	err = wgDevice.Up()
+	if err != nil {
+		wgDevice.Close()
+		return nil, fmt.Errorf("unable to bring up WireGuard device err:%s", err)
+	}
+
+	tunnel := &Tunnel{
+		Name:   name,
+		config: config,
+		device: wgDevice,
+	}
+
+	err = configureInterface(tunnel)
+	if err != nil {
+		unconfigureInterface(tunnel)
+		wgDevice.Close()
+		return nil, fmt.Errorf("unable to configure interface %s err:%s", name, err)
+	}
+
+	return tunnel, nil
+}
+
+func (t *Tunnel) handshakeDone() (bool, error) {
+	state, err := t.device.IpcGet()
+	if err != nil {
+		return false, fmt.Errorf("unable to read WireGuard device state err:%s", err)
+	}
+	for _, line := range strings.Split(state, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		if key == "last_handshake_time_sec" && value != "" && value != "0" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WireGuard has no connect step, a completed handshake is the only sign that
+// the relay is there and accepts our key.
+func (t *Tunnel) WaitForHandshake(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		done, err := t.handshakeDone()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("no handshake with %s within %s", t.config.PeerEndpoint, timeout)
+		}
+	}
+}
+
+func (t *Tunnel) Close() error {
+	err := unconfigureInterface(t)
+	t.device.Close()
+	if err != nil {
+		return fmt.Errorf("unable to restore routes for %s err:%s", t.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+func runCommand(name string, args ...string) error {
+	return runCommandInput("", name, args...)
+}
+
+// Like runCommand, with input fed to the command on stdin.
+func runCommandInput(input string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed err:%s output:%s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func runIp(args ...string) error {
+	return runCommand("ip", args...)
+}
+
+// Runs a setup command and remembers how to undo it, so a setup that fails
+// halfway still gets cleaned up by unconfigureInterface.
+func (t *Tunnel) apply(undo []string, name string, args ...string) error {
+	return t.applyInput(undo, "", name, args...)
+}
+
+func (t *Tunnel) applyInput(undo []string, input string, name string, args ...string) error {
+	err := runCommandInput(input, name, args...)
+	if err != nil {
+		return err
+	}
+	t.undo = append(t.undo, undo)
+	return nil
+}
+
+func routeFamilies(t *Tunnel) []string {
+	families := make([]string, 0, 2)
+	hasV4 := false
+	hasV6 := false
+	for _, a := range t.config.Addresses {
+		if a.Addr().Is4() {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+	if hasV4 {
+		families = append(families, "-4")
+	}
+	if hasV6 {
+		families = append(families, "-6")
+	}
+	return families
+}
+
+// Mirrors what wg-quick does for a default route: everything that is not
+// marked by the WireGuard socket goes into a dedicated table that points at
+// the tunnel, while the main table keeps handling the encrypted traffic.
+func configureInterface(t *Tunnel) error {
+	for _, a := range t.config.Addresses {
+		family := "-4"
+		if a.Addr().Is6() {
+			family = "-6"
+		}
+		err := runIp(family, "address", "add", a.String(), "dev", t.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := runIp("link", "set", "mtu", fmt.Sprint(tUNNEL_MTU), "up", "dev", t.Name)
+	if err != nil {
+		return err
+	}
+
+	table := fmt.Sprint(tUNNEL_FWMARK)
+	for _, family := range routeFamilies(t) {
+		defaultRoute := "0.0.0.0/0"
+		if family == "-6" {
+			defaultRoute = "::/0"
+		}
+		err = runIp(family, "route", "add", defaultRoute, "dev", t.Name, "table", table)
+		if err != nil {
+			return err
+		}
+		err = t.apply([]string{"ip", family, "rule", "delete", "not", "fwmark", table, "table", table},
+			"ip", family, "rule", "add", "not", "fwmark", table, "table", table)
+		if err != nil {
+			return err
+		}
+		err = t.apply([]string{"ip", family, "rule", "delete", "table", "main", "suppress_prefixlength", "0"},
+			"ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0")
+		if err != nil {
+			return err
+		}
+		configureRpFilter(t, family)
+	}
+
+	configureDNS(t)
+	return nil
+}
+
+// Replies from the relay arrive on the physical interface while the route
+// back to the relay is only in the main table for marked packets. Strict
+// rp_filter drops them unless the mark is restored before the reverse path
+// lookup, which is what wg-quick sets up with these rules. Hosts without
+// nftables usually do not filter strictly either, so this only logs.
+func configureRpFilter(t *Tunnel, family string) {
+	nftFamily := "ip"
+	if family == "-4" {
+		err := runCommand("sysctl", "-q", "net.ipv4.conf.all.src_valid_mark=1")
+		if err != nil {
+			log.Printf("Unable to enable src_valid_mark err:%s\n", err)
+		}
+	} else {
+		nftFamily = "ip6"
+	}
+
+	table := fmt.Sprintf("%s moz-vpn-%s", nftFamily, t.Name)
+	var rules strings.Builder
+	fmt.Fprintf(&rules, "add table %s\n", table)
+	fmt.Fprintf(&rules, "add chain %s preraw { type filter hook prerouting priority -300; }\n", table)
+	for _, a := range t.config.Addresses {
+		if (family == "-4") == a.Addr().Is4() {
+			fmt.Fprintf(&rules, "add rule %s preraw iifname != \"%s\" %s daddr %s fib saddr type != local drop\n", table, t.Name, nftFamily, a.Addr())
+		}
+	}
+	fmt.Fprintf(&rules, "add chain %s premangle { type filter hook prerouting priority -150; }\n", table)
+	fmt.Fprintf(&rules, "add rule %s premangle meta l4proto udp meta mark set ct mark\n", table)
+	fmt.Fprintf(&rules, "add chain %s postmangle { type filter hook postrouting priority -150; }\n", table)
+	fmt.Fprintf(&rules, "add rule %s postmangle meta l4proto udp meta mark %d ct mark set meta mark\n", table, tUNNEL_FWMARK)
+
+	undo := append([]string{"nft", "delete", "table"}, strings.Fields(table)...)
+	err := t.applyInput(undo, rules.String(), "nft", "-f", "-")
+	if err != nil {
+		log.Printf("Unable to add rp_filter rules, replies may be dropped on hosts with strict rp_filter err:%s\n", err)
+	}
+}
+
+// suppress_prefixlength 0 keeps LAN routes in the main table, so without this
+// queries to a resolver on the LAN would bypass the tunnel. Like wg-quick,
+// systemd-resolved is told to send every domain to the relay resolvers and
+// resolvconf is used where it is not running. A host with neither keeps its
+// resolvers, which is logged rather than failing the connection.
+func configureDNS(t *Tunnel) {
+	if len(t.config.DNS) == 0 {
+		return
+	}
+
+	err := configureResolved(t)
+	if err == nil {
+		return
+	}
+	log.Printf("Unable to set DNS with systemd-resolved, trying resolvconf err:%s\n", err)
+
+	err = configureResolvconf(t)
+	if err != nil {
+		log.Printf("Unable to set DNS, queries may leak outside the tunnel err:%s\n", err)
+	}
+}
+
+func configureResolved(t *Tunnel) error {
+	_, err := exec.LookPath("resolvectl")
+	if err != nil {
+		return err
+	}
+
+	args := []string{"dns", t.Name}
+	for _, addr := range t.config.DNS {
+		args = append(args, addr.String())
+	}
+	err = t.apply([]string{"resolvectl", "revert", t.Name}, "resolvectl", args...)
+	if err != nil {
+		return err
+	}
+	return runCommand("resolvectl", "domain", t.Name, "~.")
+}
+
+func configureResolvconf(t *Tunnel) error {
+	_, err := exec.LookPath("resolvconf")
+	if err != nil {
+		return err
+	}
+
+	var conf strings.Builder
+	for _, addr := range t.config.DNS {
+		fmt.Fprintf(&conf, "nameserver %s\n", addr)
+	}
+	return t.applyInput([]string{"resolvconf", "-d", t.Name, "-f"}, conf.String(),
+		"resolvconf", "-a", t.Name, "-m", "0", "-x")
+}
+
+func unconfigureInterface(t *Tunnel) error {
+	var firstErr error
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		err := runCommand(t.undo[i][0], t.undo[i][1:]...)
+		if err != nil {
+			log.Printf("Unable to undo tunnel setup err:%s\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	t.undo = nil
+	return firstErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func configureInterface(t *Tunnel) error {
+	return fmt.Errorf("configuring %s is not supported on %s", t.Name, runtime.GOOS)
+}
+
+func unconfigureInterface(t *Tunnel) error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+)
+
+func joinStrings[T fmt.Stringer](items []T) string {
+	parts := make([]string, 0, len(items))
+	for _, i := range items {
+		parts = append(parts, i.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c *TunnelConfig) WgQuick() string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", c.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", joinStrings(c.Addresses))
+	if len(c.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", joinStrings(c.DNS))
+	}
+	b.WriteString("\n")
+	b.WriteString("[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", c.PeerPubKey)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", joinStrings(c.AllowedPrefix))
+	fmt.Fprintf(&b, "Endpoint = %s\n", c.PeerEndpoint)
+	return b.String()
+}
+
+func (c *TunnelConfig) validateKeys() error {
+	_, err := keyToHex(c.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key err:%s", err)
+	}
+	_, err = keyToHex(c.PeerPubKey)
+	if err != nil {
+		return fmt.Errorf("invalid relay public key err:%s", err)
+	}
+	return nil
+}
+
+func WgQuickConfig(privKey string, d *Device, r *Relay, wg WireGuardInfo, preferIPv6 bool) (string, error) {
+	config, err := NewTunnelConfig(privKey, d, r, wg, preferIPv6)
+	if err != nil {
+		return "", err
+	}
+
+	err = config.validateKeys()
+	if err != nil {
+		return "", err
+	}
+
+	return config.WgQuick(), nil
+}
+
+func WriteWgQuickConfig(w io.Writer, privKey string, d *Device, r *Relay, wg WireGuardInfo, preferIPv6 bool) error {
+	config, err := WgQuickConfig(privKey, d, r, wg, preferIPv6)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, config)
+	if err != nil {
+		return fmt.Errorf("unable to write config err:%s", err)
+	}
+	return nil
+}
+
+// Goes through WgQuickConfig so the export matches what the library writes.
+func (m *MozApp) ExportWgQuickConfig() {
+	relay, err := m.selectedRelay(nil)
+	if err != nil {
+		dialog.ShowError(err, m.Window)
+		return
+	}
+
+	privKey, device, err := m.tunnelParts()
+	if err != nil {
+		dialog.ShowError(err, m.Window)
+		return
+	}
+
+	config, err := WgQuickConfig(privKey, device, relay, m.relays().list.WireGuard, false)
+	if err != nil {
+		dialog.ShowError(fmt.Errorf("unable to create config err:%s", err), m.Window)
+		return
+	}
+
+	saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, m.Window)
+			return
+		}
+		if writer == nil {
+			return
+		}
+		defer writer.Close()
+
+		_, err = io.WriteString(writer, config)
+		if err != nil {
+			log.Printf("Unable to write config err:%s\n", err)
+			dialog.ShowError(fmt.Errorf("unable to write config err:%s", err), m.Window)
+			return
+		}
+		log.Println("Exported wg-quick config to", writer.URI())
+	}, m.Window)
+	saveDialog.SetFileName(fmt.Sprintf("%s.conf", tUNNEL_NAME))
+	saveDialog.Show()
+}